@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// 镜像不同步超过 -admin-notify-after 时，按 CMS 中的联系方式给镜像管理员发邮件，
+// 列出不一致的文件和错误类别。每个镜像每隔 -admin-notify-interval 最多发一封，
+// -admin-notify-optout 文件中的镜像 id 或者邮箱不发送。
+
+const adminNotifyMaxFiles = 30
+
+// 邮件模板的第一行是标题，按镜像所在国家选择语言
+var adminNotifyTemplates = map[string]string{
+	"en_US": `Mirror {{.Name}} is out of sync with {{.Upstream}}
+Hello {{.AdminName}},
+
+The mirror {{.Name}} ({{.UrlPrefix}}) has been out of sync with
+{{.Upstream}} since {{.Since.Format "2006-01-02 15:04 MST"}}.
+In the last check ({{.RunId}}) {{printf "%.2f" .Progress}}% of the sampled files were up to date.
+{{if .ErrorClasses}}
+Errors seen:
+{{range .ErrorClasses}}  {{.Class}}: {{.Count}}
+{{end}}{{end}}
+Files that are stale or missing:
+{{range .Files}}  [{{.Status}}] {{.Url}}
+{{end}}{{if .MoreFiles}}  ... and {{.MoreFiles}} more
+{{end}}
+Please check the sync job of the mirror. Reply to this mail if you no longer
+want to receive these notifications.
+`,
+	"zh_CN": `镜像 {{.Name}} 与 {{.Upstream}} 不同步
+{{.AdminName}} 您好：
+
+镜像 {{.Name}}（{{.UrlPrefix}}）从 {{.Since.Format "2006-01-02 15:04 MST"}} 起与
+{{.Upstream}} 不同步，最近一次检测（{{.RunId}}）中 {{printf "%.2f" .Progress}}% 的抽样文件是最新的。
+{{if .ErrorClasses}}
+错误：
+{{range .ErrorClasses}}  {{.Class}}：{{.Count}}
+{{end}}{{end}}
+过期或缺失的文件：
+{{range .Files}}  [{{.Status}}] {{.Url}}
+{{end}}{{if .MoreFiles}}  ……还有 {{.MoreFiles}} 个
+{{end}}
+请检查镜像的同步任务。如果不想再收到此类通知，请回复本邮件。
+`,
+}
+
+var adminNotifyCountryLocales = map[string]string{
+	"CN": "zh_CN",
+}
+
+type adminNotifyFile struct {
+	Status string
+	Url    string
+}
+
+type adminNotifyErrorClass struct {
+	Class string
+	Count int
+}
+
+type adminNotifyData struct {
+	Name         string
+	AdminName    string
+	UrlPrefix    string
+	Upstream     string
+	Since        time.Time
+	RunId        string
+	Progress     float64
+	ErrorClasses []adminNotifyErrorClass
+	Files        []adminNotifyFile
+	MoreFiles    int
+}
+
+type adminNotifyMirrorState struct {
+	BadSince   time.Time `json:"badSince,omitempty"`
+	NotifiedAt time.Time `json:"notifiedAt,omitempty"`
+	Email      string    `json:"email,omitempty"`
+}
+
+func loadAdminNotifyState(filename string) (map[string]*adminNotifyMirrorState, error) {
+	state := make(map[string]*adminNotifyMirrorState)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return state, nil
+}
+
+func saveAdminNotifyState(filename string, state map[string]*adminNotifyMirrorState) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
+
+// loadAdminNotifyOptOut 读取不发送通知的镜像 id 和邮箱，每行一个，# 开头的是注释。
+func loadAdminNotifyOptOut(filename string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	if filename == "" {
+		return result, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		result[strings.ToLower(line)] = true
+	}
+	return result, scanner.Err()
+}
+
+func getMirrorLocale(m *mirror) string {
+	if locale, ok := adminNotifyCountryLocales[strings.ToUpper(m.Country)]; ok {
+		return locale
+	}
+	return "en_US"
+}
+
+// getLocalizedName 返回镜像在 locale 下的名称，CMS 中没有时返回 Name。
+func (m *mirror) getLocalizedName(locale string) string {
+	if name := m.Locale[locale]["name"]; name != "" {
+		return name
+	}
+	if m.Name != "" {
+		return m.Name
+	}
+	return m.Id
+}
+
+func getRecordNotifyStatus(record testRecord) string {
+	if record.err == nil {
+		return "stale"
+	}
+	class := classifyError(record.err)
+	if class == "http_404" {
+		return "missing"
+	}
+	return class
+}
+
+func newAdminNotifyData(run *checkRun, m *mirror, tr *testResult, since time.Time, locale string) *adminNotifyData {
+	data := &adminNotifyData{
+		Name:      m.getLocalizedName(locale),
+		AdminName: m.AdminName,
+		UrlPrefix: tr.urlPrefix,
+		Upstream:  baseUrl,
+		Since:     since,
+		RunId:     run.id,
+		Progress:  tr.percent,
+	}
+	if data.AdminName == "" {
+		data.AdminName = m.AdminEmail
+	}
+
+	errorClasses := tr.errorClasses()
+	for class, count := range errorClasses {
+		data.ErrorClasses = append(data.ErrorClasses, adminNotifyErrorClass{class, count})
+	}
+	sort.Slice(data.ErrorClasses, func(i, j int) bool {
+		return data.ErrorClasses[i].Count > data.ErrorClasses[j].Count
+	})
+
+	for _, record := range tr.records {
+		if record.equal && record.err == nil {
+			continue
+		}
+		if len(data.Files) == adminNotifyMaxFiles {
+			data.MoreFiles++
+			continue
+		}
+		data.Files = append(data.Files, adminNotifyFile{
+			Status: getRecordNotifyStatus(record),
+			Url:    joinUrl(tr.urlPrefix, record.standard.FilePath),
+		})
+	}
+	return data
+}
+
+func renderAdminNotify(locale string, data *adminNotifyData) (subject, body string, err error) {
+	text, ok := adminNotifyTemplates[locale]
+	if !ok {
+		text = adminNotifyTemplates["en_US"]
+	}
+	if optAdminNotifyTemplateDir != "" {
+		custom, err := ioutil.ReadFile(filepath.Join(optAdminNotifyTemplateDir, locale+".tmpl"))
+		if err == nil {
+			text = string(custom)
+		} else if !os.IsNotExist(err) {
+			return "", "", err
+		}
+	}
+	tmpl, err := template.New(locale).Parse(text)
+	if err != nil {
+		return "", "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", "", err
+	}
+	msg := buf.String()
+	idx := strings.Index(msg, "\n")
+	if idx == -1 {
+		return msg, "", nil
+	}
+	return msg[:idx], msg[idx+1:], nil
+}
+
+// notifyMirrorAdmins 检查每个镜像的结果，给不同步超过 -admin-notify-after 的镜像管理员发邮件。
+func notifyMirrorAdmins(run *checkRun) error {
+	var smtpClient *smtpNotifier
+	if optAdminNotifySmtp != "" {
+		var err error
+		smtpClient, err = newSmtpNotifier(optAdminNotifySmtp)
+		if err != nil {
+			return err
+		}
+	}
+	optOut, err := loadAdminNotifyOptOut(optAdminNotifyOptOut)
+	if err != nil {
+		return err
+	}
+	state, err := loadAdminNotifyState(optAdminNotifyState)
+	if err != nil {
+		return err
+	}
+
+	now := run.endTime
+	for _, tr := range run.testResults {
+		if tr.upstream || tr.cdnNodeAddress != "" || tr.urlPrefix == "" {
+			continue
+		}
+		m := run.mirrors.get(tr.name)
+		if m == nil {
+			continue
+		}
+
+		ms := state[m.Id]
+		if tr.percent >= optAdminNotifyThreshold {
+			// 恢复同步后，下次不同步时重新计时和通知
+			delete(state, m.Id)
+			continue
+		}
+		if ms == nil {
+			ms = &adminNotifyMirrorState{BadSince: run.startTime}
+			state[m.Id] = ms
+		}
+		if now.Sub(ms.BadSince) < optAdminNotifyAfter ||
+			(!ms.NotifiedAt.IsZero() && now.Sub(ms.NotifiedAt) < optAdminNotifyInterval) {
+			continue
+		}
+		if m.AdminEmail == "" {
+			log.Printf("WARN: admin notify: mirror %s has no admin email\n", m.Id)
+			continue
+		}
+		if optOut[strings.ToLower(m.Id)] || optOut[strings.ToLower(m.AdminEmail)] {
+			continue
+		}
+
+		locale := getMirrorLocale(m)
+		subject, body, err := renderAdminNotify(locale,
+			newAdminNotifyData(run, m, tr, ms.BadSince, locale))
+		if err != nil {
+			return err
+		}
+		if smtpClient == nil {
+			// 只打印时不算已经通知，配置发信服务器后仍然会发送
+			fmt.Printf("To: %s\nSubject: %s\n\n%s\n", m.AdminEmail, subject, body)
+			continue
+		}
+		err = smtpClient.sendMail([]string{m.AdminEmail}, subject, body)
+		if err != nil {
+			log.Printf("WARN: admin notify %s <%s>: %v\n", m.Id, m.AdminEmail, err)
+			continue
+		}
+		log.Printf("admin notify: sent to %s <%s>\n", m.Id, m.AdminEmail)
+		ms.NotifiedAt = now
+		ms.Email = m.AdminEmail
+	}
+
+	// 已经从 CMS 中删除的镜像
+	for id := range state {
+		if run.mirrors.get(id) == nil {
+			delete(state, id)
+		}
+	}
+	return saveAdminNotifyState(optAdminNotifyState, state)
+}
+
+func notifyMirrorAdminsIfNeeded(run *checkRun) {
+	if !optAdminNotify {
+		return
+	}
+	err := notifyMirrorAdmins(run)
+	if err != nil {
+		log.Println("WARN: admin notify:", err)
+	}
+}
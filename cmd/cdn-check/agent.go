@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 国外的镜像应该从国外的节点检测。检测时 coordinator（-agent-listen）按 -vantage-map
+// 把镜像分配给不同位置的 agent，agent 从 coordinator 领取镜像和快照中的文件列表，
+// 在本地检测后把每个镜像的结果发回 coordinator。agent 没有按时返回结果的镜像在本地检测。
+//
+//	GET  /api/agent/task?vantage=V&batch=N  领取最多 N 个分配给 V 的镜像，没有时返回 204
+//	POST /api/agent/results                 返回检测结果
+//
+// 请求头 Authorization: Bearer <AGENT_TOKEN>。
+
+type agentTask struct {
+	RunId            string              `json:"runId"`
+	Vantage          string              `json:"vantage"`
+	ValidateInfoList []*FileValidateInfo `json:"validateInfoList"`
+	Mirrors          mirrors             `json:"mirrors"`
+}
+
+type agentResults struct {
+	RunId   string            `json:"runId"`
+	Vantage string            `json:"vantage"`
+	Agent   string            `json:"agent"`
+	Mirror  string            `json:"mirror"`
+	Results []*testResultJSON `json:"results"`
+}
+
+// parseVantageMap 解析 "CN=local,JP=asia,*=eu"，国家代码 -> 位置，* 是其他国家，
+// 没有匹配的镜像在本地检测。
+func parseVantageMap(s string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid vantage map item %q", item)
+		}
+		result[strings.ToUpper(parts[0])] = parts[1]
+	}
+	return result, nil
+}
+
+type vantageMapFlag struct {
+	m *map[string]string
+}
+
+func (f vantageMapFlag) String() string {
+	if f.m == nil {
+		return ""
+	}
+	var items []string
+	for country, vantage := range *f.m {
+		items = append(items, country+"="+vantage)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (f vantageMapFlag) Set(s string) error {
+	m, err := parseVantageMap(s)
+	if err != nil {
+		return err
+	}
+	*f.m = m
+	return nil
+}
+
+func getMirrorVantage(vantageMap map[string]string, m *mirror) string {
+	if v, ok := vantageMap[strings.ToUpper(m.Country)]; ok {
+		return v
+	}
+	if v, ok := vantageMap["*"]; ok {
+		return v
+	}
+	return optVantage
+}
+
+// coordinatorRun 是正在进行的检测中分配给 agent 的镜像。
+type coordinatorRun struct {
+	id               string
+	validateInfoList []*FileValidateInfo
+	queues           map[string]mirrors // 位置 -> 还没有被领取的镜像
+	pending          map[string]string  // 还没有返回结果的镜像 id -> 位置
+	results          []*testResult
+	done             chan struct{}
+}
+
+type coordinator struct {
+	token string
+	mu    sync.Mutex
+	run   *coordinatorRun
+}
+
+var agentCoordinator *coordinator
+
+func startCoordinator(listen string) {
+	// agent 的结果直接合并到检测结果中，不允许没有认证的 coordinator
+	c := &coordinator{token: os.Getenv("AGENT_TOKEN")}
+	if c.token == "" {
+		fatal("-agent-listen requires env AGENT_TOKEN")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/agent/task", c.handleTask)
+	mux.HandleFunc("/api/agent/results", c.handleResults)
+	go func() {
+		log.Println("agent coordinator listen:", listen)
+		fatal(http.ListenAndServe(listen, mux))
+	}()
+	agentCoordinator = c
+}
+
+func (c *coordinator) authorized(r *http.Request) bool {
+	return r.Header.Get("Authorization") == "Bearer "+c.token
+}
+
+func (c *coordinator) handleTask(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	vantage := r.URL.Query().Get("vantage")
+	batch, _ := strconv.Atoi(r.URL.Query().Get("batch"))
+	if batch <= 0 {
+		batch = 1
+	}
+
+	c.mu.Lock()
+	run := c.run
+	if run == nil || len(run.queues[vantage]) == 0 {
+		c.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	queue := run.queues[vantage]
+	if batch > len(queue) {
+		batch = len(queue)
+	}
+	task := &agentTask{
+		RunId:            run.id,
+		Vantage:          vantage,
+		ValidateInfoList: run.validateInfoList,
+		Mirrors:          queue[:batch].withoutContacts(),
+	}
+	run.queues[vantage] = queue[batch:]
+	c.mu.Unlock()
+
+	var ids []string
+	for _, m := range task.Mirrors {
+		ids = append(ids, m.Id)
+	}
+	log.Printf("agent %s at %s took mirrors %v\n", r.RemoteAddr, vantage, ids)
+	writeJSON(w, http.StatusOK, task)
+}
+
+func (c *coordinator) handleResults(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var v agentResults
+	err := json.NewDecoder(r.Body).Decode(&v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	run := c.run
+	if run == nil || run.id != v.RunId {
+		writeError(w, http.StatusConflict, errors.New("run "+v.RunId+" is not in progress"))
+		return
+	}
+	if vantage, ok := run.pending[v.Mirror]; !ok || vantage != v.Vantage {
+		writeError(w, http.StatusConflict,
+			fmt.Errorf("mirror %s is not assigned to %s or already reported", v.Mirror, v.Vantage))
+		return
+	}
+	for _, trv := range v.Results {
+		if trv.Name != v.Mirror {
+			writeError(w, http.StatusBadRequest, errors.New("result of another mirror "+trv.Name))
+			return
+		}
+	}
+	var results []*testResult
+	for _, trv := range v.Results {
+		tr := trv.toTestResult()
+		setDefaultVantage(tr, v.Vantage)
+		results = append(results, tr)
+	}
+	run.results = append(run.results, results...)
+	activeJournal.finishMirror(v.Mirror, results)
+	emitMirrorDone(v.Mirror, results, 0, false)
+	delete(run.pending, v.Mirror)
+	log.Printf("agent %s at %s reported mirror %s\n", v.Agent, v.Vantage, v.Mirror)
+	if len(run.pending) == 0 {
+		close(run.done)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// testMirrors 把镜像分配给各个位置的 agent 检测，本地的镜像在本地检测，
+// agent 在 timeout 内没有返回结果的镜像也在本地检测。
+func (c *coordinator) testMirrors(runId string, mirrors0 mirrors,
+	validateInfoList []*FileValidateInfo, timeout time.Duration) []*testResult {
+	deadline := time.Now().Add(timeout)
+	run := &coordinatorRun{
+		id:               runId,
+		validateInfoList: validateInfoList,
+		queues:           make(map[string]mirrors),
+		pending:          make(map[string]string),
+		done:             make(chan struct{}),
+	}
+	var localMirrors mirrors
+	for _, m := range mirrors0 {
+		if optNoTestHidden && m.Weight < 0 {
+			continue
+		}
+		vantage := getMirrorVantage(optVantageMap, m)
+		if results := activeJournal.getFinished(m.Id); results != nil {
+			log.Printf("skip mirror %q finished before the run was interrupted\n", m.Id)
+			run.results = append(run.results, results...)
+			continue
+		}
+		if vantage == optVantage {
+			localMirrors = append(localMirrors, m)
+			continue
+		}
+		run.queues[vantage] = append(run.queues[vantage], m)
+		run.pending[m.Id] = vantage
+	}
+	if len(run.pending) == 0 {
+		close(run.done)
+	}
+	for vantage, queue := range run.queues {
+		log.Printf("assign %d mirrors to agents at %s\n", len(queue), vantage)
+	}
+
+	c.mu.Lock()
+	c.run = run
+	c.mu.Unlock()
+
+	results := testAllMirrors(localMirrors, validateInfoList)
+	for _, tr := range results {
+		setDefaultVantage(tr, optVantage)
+	}
+
+	select {
+	case <-run.done:
+	case <-time.After(time.Until(deadline)):
+	}
+
+	c.mu.Lock()
+	c.run = nil
+	results = append(results, run.results...)
+	var lateMirrors mirrors
+	for id, vantage := range run.pending {
+		log.Printf("WARN: agent at %s did not report mirror %s in time, test it locally\n", vantage, id)
+		lateMirrors = append(lateMirrors, mirrors0.get(id))
+	}
+	c.mu.Unlock()
+
+	if len(lateMirrors) > 0 {
+		lateResults := testAllMirrors(lateMirrors, validateInfoList)
+		for _, tr := range lateResults {
+			setDefaultVantage(tr, optVantage)
+		}
+		results = append(results, lateResults...)
+	}
+	return results
+}
+
+// testMirrorsDistributed 在启用了 coordinator 时把镜像分配给 agent，否则全部在本地检测。
+func testMirrorsDistributed(runId string, mirrors0 mirrors, validateInfoList []*FileValidateInfo) []*testResult {
+	if agentCoordinator == nil {
+		results := testAllMirrors(mirrors0, validateInfoList)
+		for _, tr := range results {
+			setDefaultVantage(tr, optVantage)
+		}
+		return results
+	}
+	return agentCoordinator.testMirrors(runId, mirrors0, validateInfoList, optAgentTimeout)
+}
+
+type agentClient struct {
+	coordinatorUrl string
+	vantage        string
+	name           string
+	token          string
+	client         *http.Client
+}
+
+func (a *agentClient) newRequest(method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(a.coordinatorUrl, "/")+path,
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// getTask 领取任务，没有任务时返回 nil, nil。
+func (a *agentClient) getTask(batch int) (*agentTask, error) {
+	query := url.Values{}
+	query.Set("vantage", a.vantage)
+	query.Set("batch", strconv.Itoa(batch))
+	req, err := a.newRequest(http.MethodGet, "/api/agent/task?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("get task: status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var task agentTask
+	err = json.NewDecoder(resp.Body).Decode(&task)
+	if err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+func (a *agentClient) sendResults(task *agentTask, mirrorId string, results []*testResult) error {
+	v := agentResults{
+		RunId:   task.RunId,
+		Vantage: a.vantage,
+		Agent:   a.name,
+		Mirror:  mirrorId,
+	}
+	for _, tr := range results {
+		v.Results = append(v.Results, tr.toJSON(true))
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := a.newRequest(http.MethodPost, "/api/agent/results", data)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("send results of %s: status %s: %s", mirrorId, resp.Status,
+			bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// runTask 并发检测任务中的镜像，每个镜像检测完立即返回结果。
+func (a *agentClient) runTask(task *agentTask) {
+	if task.Mirrors.get("default") != nil {
+		err := prefetchCdnDns(cdnHost)
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, m := range task.Mirrors {
+		wg.Add(1)
+		go func(m *mirror) {
+			defer wg.Done()
+			results := testMirror(m, task.ValidateInfoList)
+			// coordinator 短暂不可用时重试
+			var err error
+			for i := 0; i < 3; i++ {
+				err = a.sendResults(task, m.Id, results)
+				if err == nil {
+					return
+				}
+				time.Sleep(time.Duration(i+1) * 10 * time.Second)
+			}
+			log.Println("WARN:", err)
+		}(m)
+	}
+	wg.Wait()
+}
+
+// agentMain 实现 agent 子命令。
+func agentMain(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	a := &agentClient{
+		token:  os.Getenv("AGENT_TOKEN"),
+		client: &http.Client{Timeout: time.Minute},
+	}
+	var batch int
+	var poll time.Duration
+	fs.StringVar(&a.coordinatorUrl, "coordinator", "", "url of the coordinator, e.g. http://host:8090")
+	fs.StringVar(&a.vantage, "vantage", "", "location of this agent, as in -vantage-map of the coordinator")
+	fs.StringVar(&a.name, "name", "", "name of this agent in the logs of the coordinator, default hostname")
+	fs.IntVar(&batch, "batch", 5, "number of mirrors to test at the same time")
+	fs.DurationVar(&poll, "poll", 30*time.Second, "interval to ask for tasks when idle")
+	fs.Parse(args)
+	if a.coordinatorUrl == "" || a.vantage == "" {
+		fatal("agent requires -coordinator and -vantage")
+	}
+	if a.name == "" {
+		a.name, _ = os.Hostname()
+	}
+
+	for {
+		task, err := a.getTask(batch)
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+		if task == nil {
+			time.Sleep(poll)
+			continue
+		}
+		log.Printf("run %s: test %d mirrors\n", task.RunId, len(task.Mirrors))
+		a.runTask(task)
+	}
+}
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"mirror_status/sink"
+)
+
+// 每次检测后按告警规则检查每个镜像、CDN 节点和上游的结果，规则文件是 JSON 数组，例如
+//
+//	[
+//	  {"name": "mirror-out-of-sync", "kind": "mirror", "state": "published",
+//	   "metric": "progress", "op": "<", "threshold": 90, "forRuns": 3},
+//	  {"name": "cdn-node-out-of-sync", "kind": "cdn_node",
+//	   "metric": "progress", "op": "<", "threshold": 100, "for": "6h"},
+//	  {"name": "tls-cert-expiring", "kind": "mirror",
+//	   "metric": "cert_days", "op": "<", "threshold": 14}
+//	]
+//
+// 告警的状态保存在 -alert-state 文件中，同一个告警只在开始时通知一次，之后每隔
+// -alert-repeat 重复通知，恢复时发送恢复通知。被静默的告警不通知。
+
+const (
+	alertKindMirror   = "mirror"
+	alertKindCdnNode  = "cdn_node"
+	alertKindUpstream = "upstream"
+)
+
+// 告警规则可以使用的指标
+const (
+	alertMetricProgress = "progress"
+	alertMetricNumErrs  = "num_errs"
+	alertMetricNumFiles = "num_files"
+	alertMetricLatency  = "latency"   // 秒
+	alertMetricCertDays = "cert_days" // https 证书剩余的天数
+)
+
+type alertRule struct {
+	Name      string   `json:"name"`
+	Kind      string   `json:"kind"`
+	State     string   `json:"state,omitempty"`   // published 或 hidden，为空时不限
+	Mirrors   []string `json:"mirrors,omitempty"` // 镜像 id，可以使用通配符，为空时不限
+	Metric    string   `json:"metric"`
+	Op        string   `json:"op"`
+	Threshold float64  `json:"threshold"`
+	ForRuns   int      `json:"forRuns,omitempty"` // 连续多少次检测满足条件才告警
+	For       string   `json:"for,omitempty"`     // 满足条件持续多久才告警
+	Severity  string   `json:"severity,omitempty"`
+
+	forDuration time.Duration
+}
+
+var alertOps = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+func (rule *alertRule) check() error {
+	if rule.Name == "" {
+		return errors.New("alert rule without name")
+	}
+	switch rule.Kind {
+	case alertKindMirror, alertKindCdnNode, alertKindUpstream:
+	default:
+		return fmt.Errorf("alert rule %s: invalid kind %q", rule.Name, rule.Kind)
+	}
+	switch rule.Metric {
+	case alertMetricProgress, alertMetricNumErrs, alertMetricNumFiles, alertMetricLatency:
+	case alertMetricCertDays:
+		if rule.Kind == alertKindCdnNode {
+			return fmt.Errorf("alert rule %s: metric cert_days is not supported for cdn nodes", rule.Name)
+		}
+	default:
+		return fmt.Errorf("alert rule %s: invalid metric %q", rule.Name, rule.Metric)
+	}
+	if _, ok := alertOps[rule.Op]; !ok {
+		return fmt.Errorf("alert rule %s: invalid op %q", rule.Name, rule.Op)
+	}
+	if rule.For != "" {
+		d, err := time.ParseDuration(rule.For)
+		if err != nil {
+			return fmt.Errorf("alert rule %s: %v", rule.Name, err)
+		}
+		rule.forDuration = d
+	}
+	if rule.Severity == "" {
+		rule.Severity = "warning"
+	}
+	return nil
+}
+
+func (rule *alertRule) match(target *alertTarget) bool {
+	if rule.Kind != target.kind {
+		return false
+	}
+	if rule.State != "" && rule.State != target.state {
+		return false
+	}
+	if len(rule.Mirrors) == 0 {
+		return true
+	}
+	for _, pattern := range rule.Mirrors {
+		if ok, _ := path.Match(pattern, target.mirrorId); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func loadAlertRules(filename string) ([]*alertRule, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*alertRule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	names := make(map[string]bool)
+	for _, rule := range rules {
+		err = rule.check()
+		if err != nil {
+			return nil, err
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate alert rule %s", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	return rules, nil
+}
+
+// alertTarget 是告警的对象：一个镜像、一个 CDN 节点或者上游。
+type alertTarget struct {
+	kind      string
+	mirrorId  string
+	node      string
+	urlPrefix string
+	state     string
+	result    *testResult
+
+	certDays   float64
+	certDaysOk *bool
+}
+
+func (t *alertTarget) name() string {
+	if t.node != "" {
+		return t.mirrorId + "/" + t.node
+	}
+	return t.mirrorId
+}
+
+func getAlertTargets(run *checkRun) []*alertTarget {
+	var targets []*alertTarget
+	for _, tr := range run.testResults {
+		if tr.urlPrefix == "" {
+			continue
+		}
+		t := &alertTarget{
+			mirrorId:  tr.name,
+			node:      tr.cdnNodeAddress,
+			urlPrefix: tr.urlPrefix,
+			result:    tr,
+		}
+		switch {
+		case tr.upstream:
+			t.kind = alertKindUpstream
+			t.state = "upstream"
+		case tr.cdnNodeAddress != "":
+			t.kind = alertKindCdnNode
+		default:
+			t.kind = alertKindMirror
+		}
+		if m := run.mirrors.get(tr.name); m != nil {
+			t.state = sink.MirrorState(m.Weight)
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// getCertDays 返回 https 证书剩余的天数，不是 https 时 ok 为 false。
+func getCertDays(urlPrefix string) (days float64, ok bool, err error) {
+	u, err := url.Parse(urlPrefix)
+	if err != nil {
+		return 0, false, err
+	}
+	if u.Scheme != "https" {
+		return 0, false, nil
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	// 证书已经过期或者不受信任时也要拿到过期时间
+	conn, err := tls.DialWithDialer(dialer, "tcp", host, &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return 0, true, err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return 0, true, errors.New("no certificate from " + host)
+	}
+	return time.Until(certs[0].NotAfter).Hours() / 24, true, nil
+}
+
+func (t *alertTarget) getValue(metric string) (value float64, ok bool) {
+	tr := t.result
+	switch metric {
+	case alertMetricProgress:
+		return tr.percent, true
+	case alertMetricNumErrs:
+		return float64(tr.numErrs), true
+	case alertMetricNumFiles:
+		return float64(len(tr.records)), true
+	case alertMetricLatency:
+		return tr.avgLatency().Seconds(), true
+	case alertMetricCertDays:
+		// 多条规则使用 cert_days 时只连接一次
+		if t.certDaysOk == nil {
+			days, ok, err := getCertDays(t.urlPrefix)
+			if err != nil {
+				log.Printf("WARN: get certificate of %s: %v\n", t.urlPrefix, err)
+			}
+			ok = ok && err == nil
+			t.certDays, t.certDaysOk = days, &ok
+		}
+		return t.certDays, *t.certDaysOk
+	}
+	return 0, false
+}
+
+const (
+	alertStatusPending  = "pending"
+	alertStatusFiring   = "firing"
+	alertStatusResolved = "resolved"
+)
+
+// alert 是一条规则在一个对象上的告警状态。
+type alert struct {
+	Rule       string    `json:"rule"`
+	Target     string    `json:"target"`
+	Kind       string    `json:"kind"`
+	Severity   string    `json:"severity"`
+	Status     string    `json:"status"`
+	Value      float64   `json:"value"`
+	Message    string    `json:"message"`
+	ActiveAt   time.Time `json:"activeAt"`   // 第一次满足条件的时间
+	NumRuns    int       `json:"numRuns"`    // 连续满足条件的次数
+	FiredAt    time.Time `json:"firedAt"`    // 开始告警的时间
+	NotifiedAt time.Time `json:"notifiedAt"` // 最后一次通知的时间，为零时没有通知过
+	ResolvedAt time.Time `json:"resolvedAt,omitempty"`
+	// 恢复通知还没有发送成功
+	ResolvePending bool `json:"resolvePending,omitempty"`
+}
+
+func (a *alert) key() string {
+	return a.Rule + "|" + a.Target
+}
+
+type silence struct {
+	Id        string    `json:"id"`
+	Rule      string    `json:"rule"`   // 可以使用通配符
+	Target    string    `json:"target"` // 可以使用通配符
+	Until     time.Time `json:"until"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (s *silence) match(a *alert, now time.Time) bool {
+	if now.After(s.Until) {
+		return false
+	}
+	ruleOk, _ := path.Match(s.Rule, a.Rule)
+	targetOk, _ := path.Match(s.Target, a.Target)
+	return ruleOk && targetOk
+}
+
+type alertState struct {
+	Alerts   map[string]*alert `json:"alerts"`
+	Silences []*silence        `json:"silences"`
+}
+
+func loadAlertState(filename string) (*alertState, error) {
+	state := &alertState{Alerts: make(map[string]*alert)}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if state.Alerts == nil {
+		state.Alerts = make(map[string]*alert)
+	}
+	return state, nil
+}
+
+func (state *alertState) save(filename string) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
+
+func (state *alertState) silenced(a *alert, now time.Time) bool {
+	for _, s := range state.Silences {
+		if s.match(a, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeExpiredSilences 删除过期一天以上的静默。
+func (state *alertState) removeExpiredSilences(now time.Time) {
+	var silences []*silence
+	for _, s := range state.Silences {
+		if now.Sub(s.Until) < 24*time.Hour {
+			silences = append(silences, s)
+		}
+	}
+	state.Silences = silences
+}
+
+func formatAlertValue(metric string, value float64) string {
+	switch metric {
+	case alertMetricProgress:
+		return fmt.Sprintf("%.3f%%", value)
+	case alertMetricLatency:
+		return fmt.Sprintf("%.3fs", value)
+	case alertMetricCertDays:
+		return fmt.Sprintf("%.1f days", value)
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// evaluateAlerts 用一次检测的结果更新告警状态，返回需要通知的告警。
+// complete 为 false 时 run 只有部分对象的结果，不在 run 中的告警保持不变。
+func evaluateAlerts(state *alertState, rules []*alertRule, run *checkRun,
+	complete bool, repeat time.Duration) []*alert {
+	now := run.endTime
+	var notify []*alert
+	seen := make(map[string]bool)
+	ruleNames := make(map[string]bool)
+	targets := getAlertTargets(run)
+
+	for _, rule := range rules {
+		ruleNames[rule.Name] = true
+		for _, target := range targets {
+			if !rule.match(target) {
+				continue
+			}
+			value, ok := target.getValue(rule.Metric)
+			if !ok {
+				continue
+			}
+			key := rule.Name + "|" + target.name()
+			seen[key] = true
+			a := state.Alerts[key]
+			if !alertOps[rule.Op](value, rule.Threshold) {
+				if a != nil && a.Status != alertStatusResolved {
+					a.Value = value
+					a.Message = fmt.Sprintf("%s %s is %s", target.name(), rule.Metric,
+						formatAlertValue(rule.Metric, value))
+					resolveAlert(state, a, now)
+				}
+				continue
+			}
+
+			if a == nil || a.Status == alertStatusResolved {
+				a = &alert{
+					Rule:     rule.Name,
+					Target:   target.name(),
+					Kind:     target.kind,
+					Severity: rule.Severity,
+					Status:   alertStatusPending,
+					ActiveAt: now,
+				}
+				state.Alerts[key] = a
+			}
+			a.NumRuns++
+			a.Value = value
+			a.Message = fmt.Sprintf("%s %s is %s, %s %s", target.name(), rule.Metric,
+				formatAlertValue(rule.Metric, value), rule.Op,
+				formatAlertValue(rule.Metric, rule.Threshold))
+
+			if a.Status == alertStatusPending &&
+				a.NumRuns >= rule.ForRuns && now.Sub(a.ActiveAt) >= rule.forDuration {
+				a.Status = alertStatusFiring
+				a.FiredAt = now
+			}
+			if a.Status == alertStatusFiring && !state.silenced(a, now) &&
+				(a.NotifiedAt.IsZero() || (repeat > 0 && now.Sub(a.NotifiedAt) >= repeat)) {
+				notify = append(notify, a)
+			}
+		}
+	}
+
+	// 规则被删除或者对象不存在了（例如镜像被删除、CDN 节点下线）
+	for key, a := range state.Alerts {
+		if a.Status == alertStatusResolved || seen[key] {
+			continue
+		}
+		if ruleNames[a.Rule] {
+			if !complete {
+				continue
+			}
+			a.Message = a.Target + " is no longer checked"
+		} else {
+			a.Message = "rule " + a.Rule + " is removed"
+		}
+		resolveAlert(state, a, now)
+	}
+
+	// 恢复一天以上的告警不再保留，恢复通知没有发送成功的重新发送
+	for key, a := range state.Alerts {
+		if a.Status != alertStatusResolved {
+			continue
+		}
+		if now.Sub(a.ResolvedAt) > 24*time.Hour {
+			delete(state.Alerts, key)
+		} else if a.ResolvePending {
+			notify = append(notify, a)
+		}
+	}
+	state.removeExpiredSilences(now)
+
+	sort.Slice(notify, func(i, j int) bool {
+		return notify[i].key() < notify[j].key()
+	})
+	return notify
+}
+
+// resolveAlert 把告警标记为已恢复，通知过的告警需要发送恢复通知。
+func resolveAlert(state *alertState, a *alert, now time.Time) {
+	wasNotified := a.Status == alertStatusFiring && !a.NotifiedAt.IsZero()
+	a.Status = alertStatusResolved
+	a.ResolvedAt = now
+	a.NumRuns = 0
+	a.ResolvePending = wasNotified && !state.silenced(a, now)
+}
+
+// markAlertsNotified 在通知发送成功后记录通知时间。
+func markAlertsNotified(alerts []*alert, now time.Time) {
+	for _, a := range alerts {
+		a.NotifiedAt = now
+		if a.Status == alertStatusResolved {
+			a.ResolvePending = false
+		}
+	}
+}
+
+// evaluateAlertsIfNeeded 在检测后检查告警规则并发送通知。
+func evaluateAlertsIfNeeded(run *checkRun, complete bool) {
+	if optAlertRules == "" {
+		return
+	}
+	err := evaluateAlertsAndNotify(run, complete)
+	if err != nil {
+		log.Println("WARN: alert:", err)
+	}
+}
+
+func evaluateAlertsAndNotify(run *checkRun, complete bool) error {
+	rules, err := loadAlertRules(optAlertRules)
+	if err != nil {
+		return err
+	}
+	notifiers, err := parseNotifiers(optAlertNotify)
+	if err != nil {
+		return err
+	}
+	state, err := loadAlertState(optAlertState)
+	if err != nil {
+		return err
+	}
+
+	alerts := evaluateAlerts(state, rules, run, complete, optAlertRepeat)
+	if len(alerts) > 0 {
+		log.Printf("alert: %d notifications\n", len(alerts))
+		// 至少一个通知目标发送成功才记为已通知，否则下次检测时重新发送
+		notified := false
+		for _, n := range notifiers {
+			err = n.notify(alerts)
+			if err != nil {
+				log.Printf("WARN: alert notify %s: %v\n", n.name(), err)
+				continue
+			}
+			notified = true
+		}
+		if notified {
+			markAlertsNotified(alerts, run.endTime)
+		}
+	}
+	return state.save(optAlertState)
+}
+
+// alertMain 实现 alert 子命令，查看告警和管理静默。
+func alertMain(args []string) {
+	if len(args) == 0 {
+		alertUsage()
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("alert "+cmd, flag.ExitOnError)
+	var rule, target, comment string
+	var duration time.Duration
+	fs.StringVar(&rule, "rule", "*", "rule name, wildcards allowed")
+	fs.StringVar(&target, "target", "*", "mirror id or mirror id/cdn node, wildcards allowed")
+	fs.DurationVar(&duration, "for", 24*time.Hour, "silence duration")
+	fs.StringVar(&comment, "comment", "", "why the alerts are silenced")
+	fs.Parse(args[1:])
+
+	state, err := loadAlertState(optAlertState)
+	if err != nil {
+		fatal(err)
+	}
+	now := time.Now()
+
+	switch cmd {
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		var alerts []*alert
+		for _, a := range state.Alerts {
+			alerts = append(alerts, a)
+		}
+		sort.Slice(alerts, func(i, j int) bool {
+			return alerts[i].key() < alerts[j].key()
+		})
+		fmt.Fprintln(w, "RULE\tTARGET\tSTATUS\tSINCE\tMESSAGE")
+		for _, a := range alerts {
+			status := a.Status
+			if status != alertStatusResolved && state.silenced(a, now) {
+				status += ",silenced"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", a.Rule, a.Target, status,
+				a.ActiveAt.Format("2006-01-02 15:04"), a.Message)
+		}
+		fmt.Fprintln(w, "\nSILENCE\tRULE\tTARGET\tUNTIL\tCOMMENT")
+		for _, s := range state.Silences {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Id, s.Rule, s.Target,
+				s.Until.Format("2006-01-02 15:04"), s.Comment)
+		}
+		w.Flush()
+		return
+
+	case "silence":
+		if _, err := path.Match(rule, ""); err != nil {
+			fatal(err)
+		}
+		if _, err := path.Match(target, ""); err != nil {
+			fatal(err)
+		}
+		s := &silence{
+			Id:        strconv.FormatInt(now.UnixNano(), 36),
+			Rule:      rule,
+			Target:    target,
+			Until:     now.Add(duration),
+			Comment:   comment,
+			CreatedAt: now,
+		}
+		state.Silences = append(state.Silences, s)
+		fmt.Println("silence", s.Id, "until", s.Until.Format("2006-01-02 15:04"))
+
+	case "unsilence":
+		if fs.NArg() == 0 {
+			alertUsage()
+		}
+		ids := make(map[string]bool)
+		for _, id := range fs.Args() {
+			ids[id] = true
+		}
+		var silences []*silence
+		for _, s := range state.Silences {
+			if ids[s.Id] {
+				delete(ids, s.Id)
+				continue
+			}
+			silences = append(silences, s)
+		}
+		if len(ids) > 0 {
+			var notFound []string
+			for id := range ids {
+				notFound = append(notFound, id)
+			}
+			fatal("silence not found: ", strings.Join(notFound, " "))
+		}
+		state.Silences = silences
+
+	default:
+		alertUsage()
+	}
+
+	err = state.save(optAlertState)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func alertUsage() {
+	fmt.Fprintln(os.Stderr, `usage: cdn-check [-alert-state FILE] alert COMMAND [flags]
+
+commands:
+  list                                                    list alerts and silences
+  silence [-rule R] [-target T] [-for 24h] [-comment C]   silence matching alerts
+  unsilence ID...                                         remove silences`)
+	os.Exit(2)
+}
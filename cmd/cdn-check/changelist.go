@@ -17,7 +17,8 @@ import (
 )
 
 const (
-	baseUrl       = "http://packages.deepin.com/deepin/"
+	repoName      = "deepin"
+	baseUrl       = "http://packages.deepin.com/" + repoName + "/"
 	changeListUrl = baseUrl + "changelist/"
 )
 
@@ -67,25 +68,7 @@ func (v changeMetaInfoSlice) Swap(i, j int) {
 	v[i], v[j] = v[j], v[i]
 }
 
-func ignoreFile(filename string) bool {
-	if strings.Contains(filename, "__GUARD__") ||
-		strings.Contains(filename, "/Sources.diff/") ||
-		strings.Contains(filename, "/Packages.diff/") {
-		return true
-	} else if strings.HasPrefix(filename, "pool/") {
-		// in pool dir
-		if !strings.HasSuffix(filename, ".deb") {
-			return true
-		}
-
-		if strings.HasSuffix(filename, "_i386.deb") {
-			return true
-		}
-	}
-	return false
-}
-
-func getChangeFiles() ([]string, error) {
+func getChangeFiles(rng *rand.Rand) ([]string, error) {
 	changeList, err := getChangeList()
 	if err != nil {
 		return nil, err
@@ -126,8 +109,9 @@ func getChangeFiles() ([]string, error) {
 		recentlyChanges[i], recentlyChanges[opp] = recentlyChanges[opp], recentlyChanges[i]
 	}
 
-	debChangeFilesMap := make(map[string]struct{})
-	nonDebChangeFilesMap := make(map[string]struct{})
+	// pool 中的文件路径 -> 最近添加它的 changelist
+	poolChangeFilesMap := make(map[string]string)
+	nonPoolChangeFilesMap := make(map[string]struct{})
 	var changeFiles []string
 	for _, name := range recentlyChanges {
 		ci, err := getChangeInfo(name)
@@ -141,43 +125,21 @@ func getChangeFiles() ([]string, error) {
 				continue
 			}
 
-			if strings.HasSuffix(a.FilePath, ".deb") {
-				debChangeFilesMap[a.FilePath] = struct{}{}
+			if strings.HasPrefix(a.FilePath, "pool/") {
+				poolChangeFilesMap[a.FilePath] = name
 			} else {
-				nonDebChangeFilesMap[a.FilePath] = struct{}{}
+				nonPoolChangeFilesMap[a.FilePath] = struct{}{}
 			}
 		}
 	}
-	// about 300 deb files selected
-	changeFiles = randSelectN(debChangeFilesMap, 300)
-	for file := range nonDebChangeFilesMap {
+	// about optSampleSize pool files selected, stratified by component/arch/changelist
+	changeFiles = randSelectN(poolChangeFilesMap, optSampleSize, rng)
+	for file := range nonPoolChangeFilesMap {
 		changeFiles = append(changeFiles, file)
 	}
 	return changeFiles, nil
 }
 
-func randSelectN(in map[string]struct{}, n int) (result []string) {
-	total := len(in)
-
-	if total <= n {
-		var idx int
-		result = make([]string, total)
-		for key := range in {
-			result[idx] = key
-			idx++
-		}
-		return
-	}
-
-	selectedRate := float64(n) / float64(total)
-	for key := range in {
-		if rand.Float64() <= selectedRate {
-			result = append(result, key)
-		}
-	}
-	return
-}
-
 func getChangeInfo(name string) (*changeInfo, error) {
 	u := changeListUrl + name
 	log.Println("getChangeInfo u:", u)
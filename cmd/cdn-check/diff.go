@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// diffResult 是一个镜像或者 CDN 节点在一次检测中的结果
+type diffResult struct {
+	name           string
+	cdnNodeAddress string
+	percent        float64
+	numErrs        int
+}
+
+func (r *diffResult) key() string {
+	if r.cdnNodeAddress != "" {
+		return r.name + "/" + r.cdnNodeAddress
+	}
+	return r.name
+}
+
+// diffRun 是 diff 子命令比较的一次检测，files 是每个镜像每个文件的状态，
+// 一致时为空，否则为错误类别或者 not_equal，CDN 任一节点不一致就认为不一致。
+type diffRun struct {
+	id      string
+	results map[string]*diffResult
+	files   map[string]map[string]string
+}
+
+func newDiffRun(id string) *diffRun {
+	return &diffRun{
+		id:      id,
+		results: make(map[string]*diffResult),
+		files:   make(map[string]map[string]string),
+	}
+}
+
+func (run *diffRun) setFile(mirrorId, filePath, status string) {
+	files := run.files[mirrorId]
+	if files == nil {
+		files = make(map[string]string)
+		run.files[mirrorId] = files
+	}
+	if old, ok := files[filePath]; ok && old != "" {
+		return
+	}
+	files[filePath] = status
+}
+
+func (run *diffRun) errorClasses(mirrorId string) map[string]int {
+	result := make(map[string]int)
+	for _, status := range run.files[mirrorId] {
+		if status != "" {
+			result[status]++
+		}
+	}
+	return result
+}
+
+// loadDiffRun 加载 cdn-check 保存的 JSON 结果，name 不是文件时
+// 作为 run id 从历史数据库中加载，latest 和 previous 是最近两次检测。
+func loadDiffRun(name string) (*diffRun, error) {
+	if _, err := os.Stat(name); err == nil {
+		return loadDiffRunFile(name)
+	}
+	return loadDiffRunHistory(optHistoryDB, name)
+}
+
+func loadDiffRunFile(filename string) (*diffRun, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var v runJSON
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	run := newDiffRun(v.Id)
+	if run.id == "" {
+		run.id = filename
+	}
+	for _, trv := range v.Results {
+		// 和历史数据库一样，上游不是镜像
+		if trv.Upstream || trv.UrlPrefix == "" {
+			continue
+		}
+		r := &diffResult{
+			name:           trv.Name,
+			cdnNodeAddress: trv.CdnNodeAddress,
+			percent:        trv.Percent,
+			numErrs:        trv.NumErrs,
+		}
+		run.results[r.key()] = r
+		for _, rv := range trv.Records {
+			var status string
+			if rv.Err != "" {
+				status = rv.ErrClass
+				if status == "" {
+					status = "other"
+				}
+			} else if !rv.Equal {
+				status = fileStatusNotEqual
+			}
+			run.setFile(trv.Name, rv.Standard.FilePath, status)
+		}
+	}
+	return run, nil
+}
+
+func loadDiffRunHistory(filename, runId string) (*diffRun, error) {
+	db, err := openHistoryDB(filename, true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var run *diffRun
+	err = db.View(func(tx *bolt.Tx) error {
+		runs := tx.Bucket(bucketRuns)
+		if runs == nil {
+			return errors.New("no history")
+		}
+		c := runs.Cursor()
+		var k []byte
+		switch runId {
+		case "latest":
+			k, _ = c.Last()
+		case "previous":
+			c.Last()
+			k, _ = c.Prev()
+		default:
+			k = []byte(runId)
+			if runs.Get(k) == nil {
+				k = nil
+			}
+		}
+		if k == nil {
+			return fmt.Errorf("run %s not found in %s", runId, filename)
+		}
+		run = newDiffRun(string(k))
+
+		prefix := []byte(run.id)
+		if pb := tx.Bucket(bucketMirrors); pb != nil {
+			err := pb.ForEach(func(name, _ []byte) error {
+				c := pb.Bucket(name).Cursor()
+				for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+					var hr historyMirrorResult
+					err := json.Unmarshal(v, &hr)
+					if err != nil {
+						return err
+					}
+					r := &diffResult{
+						name:           string(name),
+						cdnNodeAddress: hr.CdnNodeAddress,
+						percent:        hr.Percent,
+						numErrs:        hr.NumErrs,
+					}
+					run.results[r.key()] = r
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		prefix = []byte(run.id + "/")
+		if pb := tx.Bucket(bucketFiles); pb != nil {
+			return pb.ForEach(func(name, _ []byte) error {
+				c := pb.Bucket(name).Cursor()
+				for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+					var fr historyFileRecord
+					err := json.Unmarshal(v, &fr)
+					if err != nil {
+						return err
+					}
+					var status string
+					switch fr.Status {
+					case fileStatusError:
+						status = fr.ErrClass
+					case fileStatusNotEqual:
+						status = fileStatusNotEqual
+					}
+					run.setFile(string(name), string(k[len(prefix):]), status)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return run, err
+}
+
+type diffOptions struct {
+	maxDrop           float64
+	ignoreNewErrors   bool
+	ignoreNodeChanges bool
+	numFiles          int
+}
+
+type diffReport struct {
+	regressions  []string
+	improvements []string
+	changes      []string
+}
+
+// diffRuns 比较两次检测，返回变差、恢复和其他变化。
+func diffRuns(oldRun, newRun *diffRun, opts diffOptions) *diffReport {
+	report := &diffReport{}
+	regress := func(format string, a ...interface{}) {
+		report.regressions = append(report.regressions, fmt.Sprintf(format, a...))
+	}
+	improve := func(format string, a ...interface{}) {
+		report.improvements = append(report.improvements, fmt.Sprintf(format, a...))
+	}
+	change := func(format string, a ...interface{}) {
+		report.changes = append(report.changes, fmt.Sprintf(format, a...))
+	}
+
+	var keys []string
+	for key := range oldRun.results {
+		keys = append(keys, key)
+	}
+	for key := range newRun.results {
+		if _, ok := oldRun.results[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		o := oldRun.results[key]
+		n := newRun.results[key]
+		switch {
+		case n == nil:
+			if o.cdnNodeAddress != "" && !opts.ignoreNodeChanges {
+				regress("%-40s cdn node disappeared", key)
+			} else {
+				change("%-40s removed", key)
+			}
+		case o == nil:
+			change("%-40s added, %.3f%%", key, n.percent)
+		case o.percent-n.percent > opts.maxDrop:
+			regress("%-40s %.3f%% -> %.3f%% (%+.3f)", key, o.percent, n.percent, n.percent-o.percent)
+		case n.percent-o.percent > opts.maxDrop || (n.percent == 100 && o.percent < 100):
+			improve("%-40s %.3f%% -> %.3f%% (%+.3f)", key, o.percent, n.percent, n.percent-o.percent)
+		}
+	}
+
+	var mirrorIds []string
+	for mirrorId := range newRun.files {
+		if _, ok := oldRun.files[mirrorId]; ok {
+			mirrorIds = append(mirrorIds, mirrorId)
+		}
+	}
+	sort.Strings(mirrorIds)
+
+	for _, mirrorId := range mirrorIds {
+		oldClasses := oldRun.errorClasses(mirrorId)
+		newClasses := newRun.errorClasses(mirrorId)
+		var appeared, disappeared []string
+		for class, n := range newClasses {
+			if class != fileStatusNotEqual && oldClasses[class] == 0 {
+				appeared = append(appeared, fmt.Sprintf("%s(%d)", class, n))
+			}
+		}
+		for class, n := range oldClasses {
+			if class != fileStatusNotEqual && newClasses[class] == 0 {
+				disappeared = append(disappeared, fmt.Sprintf("%s(%d)", class, n))
+			}
+		}
+		sort.Strings(appeared)
+		sort.Strings(disappeared)
+		if len(appeared) > 0 {
+			if opts.ignoreNewErrors {
+				change("%-40s new errors: %s", mirrorId, strings.Join(appeared, " "))
+			} else {
+				regress("%-40s new errors: %s", mirrorId, strings.Join(appeared, " "))
+			}
+		}
+		if len(disappeared) > 0 {
+			improve("%-40s errors gone: %s", mirrorId, strings.Join(disappeared, " "))
+		}
+
+		// 两次检测都抽到的文件中，以前一致现在不一致的文件
+		var broken []string
+		oldFiles := oldRun.files[mirrorId]
+		for filePath, status := range newRun.files[mirrorId] {
+			oldStatus, ok := oldFiles[filePath]
+			if ok && oldStatus == "" && status != "" {
+				broken = append(broken, filePath+" ("+status+")")
+			}
+		}
+		if len(broken) > 0 {
+			sort.Strings(broken)
+			more := ""
+			if len(broken) > opts.numFiles {
+				more = fmt.Sprintf(" ... %d more", len(broken)-opts.numFiles)
+				broken = broken[:opts.numFiles]
+			}
+			change("%-40s newly out of sync: %s%s", mirrorId, strings.Join(broken, ", "), more)
+		}
+	}
+	return report
+}
+
+func (report *diffReport) writeTo(w io.Writer, oldRun, newRun *diffRun) {
+	fmt.Fprintf(w, "diff %s -> %s\n", oldRun.id, newRun.id)
+	section := func(title string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s (%d):\n", title, len(lines))
+		for _, line := range lines {
+			fmt.Fprintln(w, "  "+line)
+		}
+	}
+	section("regressions", report.regressions)
+	section("improvements", report.improvements)
+	section("changes", report.changes)
+	if len(report.regressions)+len(report.improvements)+len(report.changes) == 0 {
+		fmt.Fprintln(w, "no change")
+	}
+}
+
+// diffMain 实现 diff 子命令，比较两次检测的结果，
+// 变差的数量超过 -max-regressions 时以状态 1 退出，可以用于 CI。
+func diffMain(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	var opts diffOptions
+	var maxRegressions int
+	fs.Float64Var(&opts.maxDrop, "max-drop", 1,
+		"progress drop in percentage points not counted as a regression")
+	fs.IntVar(&maxRegressions, "max-regressions", 0,
+		"exit with status 1 if there are more regressions than this")
+	fs.BoolVar(&opts.ignoreNewErrors, "ignore-new-errors", false,
+		"do not count new error classes as regressions")
+	fs.BoolVar(&opts.ignoreNodeChanges, "ignore-node-changes", false,
+		"do not count disappeared cdn nodes as regressions")
+	fs.IntVar(&opts.numFiles, "files", 5, "number of newly out of sync files to show per mirror")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, `usage: cdn-check diff [flags] OLD NEW
+
+OLD and NEW are JSON results saved by cdn-check (result/run.json, serve-data/runs/ID.json),
+or run ids in -history-db, latest and previous are the last two runs.`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if opts.numFiles < 0 {
+		fatal("-files must not be negative")
+	}
+
+	oldRun, err := loadDiffRun(fs.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	newRun, err := loadDiffRun(fs.Arg(1))
+	if err != nil {
+		fatal(err)
+	}
+
+	report := diffRuns(oldRun, newRun, opts)
+	report.writeTo(os.Stdout, oldRun, newRun)
+	if len(report.regressions) > maxRegressions {
+		os.Exit(1)
+	}
+}
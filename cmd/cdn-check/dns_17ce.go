@@ -123,10 +123,11 @@ type SpeedResponse struct {
 	Data  json.RawMessage `json:"data"`
 }
 
-func testDNS(host string) ([]string, error) {
+// testDNS 从全国各地的 17ce 节点解析 host，返回得到的 IP 和 IP 所在的地区。
+func testDNS(host string) ([]string, map[string]string, error) {
 	checkUserResult, err := checkUser(host, "dns")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	user := checkUserResult.Data.User
@@ -154,7 +155,7 @@ func testDNS(host string) ([]string, error) {
 	websocket.DefaultDialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	conn, _, err := websocket.DefaultDialer.Dial(url0.String(), header)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer conn.Close()
 
@@ -173,22 +174,23 @@ func testDNS(host string) ([]string, error) {
 	// read first msg
 	_, _, err = conn.ReadMessage()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// send DNS test request
 	err = conn.WriteJSON(&speedReq)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var ips []string
+	regions := make(map[string]string)
 
 	for {
 		var resp SpeedResponse
 		err = conn.ReadJSON(&resp)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if resp.Type == "TaskEnd" {
 			log.Println("task end")
@@ -224,6 +226,7 @@ func testDNS(host string) ([]string, error) {
 				}
 				if !found {
 					ips = append(ips, srcIp)
+					regions[srcIp] = strings.TrimSpace(newData.SrcIP0.SrcIpFrom)
 				}
 			}
 
@@ -231,7 +234,7 @@ func testDNS(host string) ([]string, error) {
 
 	}
 
-	return ips, nil
+	return ips, regions, nil
 }
 
 type NewData struct {
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// classifyError 把检测文件时的错误分类，用于统计和报告。
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if strings.Contains(err.Error(), "lookup ") {
+			return "dns"
+		}
+		return "timeout"
+	}
+
+	errMsg := err.Error()
+	switch {
+	case strings.Contains(errMsg, errByteBudgetExceeded.Error()):
+		return "budget"
+	case strings.Contains(errMsg, "no such host"),
+		regErrLookupTimeout.MatchString(errMsg):
+		return "dns"
+	case strings.Contains(errMsg, "Client.Timeout exceeded"),
+		strings.Contains(errMsg, "i/o timeout"),
+		strings.Contains(errMsg, "connection timed out"),
+		strings.Contains(errMsg, "TLS handshake timeout"):
+		return "timeout"
+	case strings.Contains(errMsg, "connection refused"):
+		return "connection_refused"
+	case strings.Contains(errMsg, "connection reset by peer"),
+		strings.Contains(errMsg, "EOF"):
+		return "connection_reset"
+	case strings.Contains(errMsg, "network is unreachable"),
+		strings.Contains(errMsg, "no route to host"):
+		return "unreachable"
+	case strings.Contains(errMsg, "x509:"),
+		strings.Contains(errMsg, "tls:"):
+		return "tls"
+	case strings.HasPrefix(errMsg, "response status is 404"):
+		return "http_404"
+	case strings.HasPrefix(errMsg, "response status is 4"):
+		return "http_4xx"
+	case strings.HasPrefix(errMsg, "response status is 5"):
+		return "http_5xx"
+	case strings.HasPrefix(errMsg, "parseContentRange"),
+		strings.Contains(errMsg, "posStart"),
+		strings.Contains(errMsg, "posEnd"),
+		strings.Contains(errMsg, "total not match"):
+		return "range"
+	}
+	return "other"
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// 检测过程中的结构化事件。-events 把事件以 JSON lines 写入文件（- 为标准输出），
+// -tui 在终端中显示每个镜像的进度。事件类型：
+//
+//	run_start     开始检测，numMirrors、numFiles
+//	mirror_start  开始检测镜像或者 CDN 节点，total 是文件数，done 是上次中断前已经检测的文件数
+//	file_checked  检测完一个文件，status 为 equal、not_equal 或 error
+//	retry         重试一个请求，有 mirror、node、url 和 attempt
+//	mirror_done   镜像检测完成，CDN 包括所有节点
+//	push_done     结果推送完成，numErrs 是推送失败的次数
+const (
+	eventRunStart    = "run_start"
+	eventMirrorStart = "mirror_start"
+	eventFileChecked = "file_checked"
+	eventRetry       = "retry"
+	eventMirrorDone  = "mirror_done"
+	eventPushDone    = "push_done"
+)
+
+type event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	RunId      string    `json:"runId,omitempty"`
+	Mirror     string    `json:"mirror,omitempty"`
+	Node       string    `json:"node,omitempty"`
+	Vantage    string    `json:"vantage,omitempty"`
+	File       string    `json:"file,omitempty"`
+	Url        string    `json:"url,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	ErrClass   string    `json:"errClass,omitempty"`
+	Attempt    int       `json:"attempt,omitempty"`
+	Total      int       `json:"total,omitempty"`
+	Done       int       `json:"done,omitempty"`
+	NumMirrors int       `json:"numMirrors,omitempty"`
+	NumFiles   int       `json:"numFiles,omitempty"`
+	NumErrs    int       `json:"numErrs,omitempty"`
+	Percent    float64   `json:"percent,omitempty"`
+	Resumed    bool      `json:"resumed,omitempty"`
+	// 毫秒
+	Latency  int64 `json:"latency,omitempty"`
+	Duration int64 `json:"duration,omitempty"`
+}
+
+type eventHandler interface {
+	handleEvent(e *event)
+}
+
+var eventHandlers struct {
+	mu       sync.Mutex
+	handlers []eventHandler
+}
+
+func addEventHandler(h eventHandler) {
+	eventHandlers.mu.Lock()
+	eventHandlers.handlers = append(eventHandlers.handlers, h)
+	eventHandlers.mu.Unlock()
+}
+
+// emitEvent 把事件发给所有 handler，没有 handler 时什么都不做。
+func emitEvent(e *event) {
+	eventHandlers.mu.Lock()
+	handlers := eventHandlers.handlers
+	eventHandlers.mu.Unlock()
+	if len(handlers) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, h := range handlers {
+		h.handleEvent(e)
+	}
+}
+
+func recordStatus(record testRecord) string {
+	switch {
+	case record.err != nil:
+		return "error"
+	case record.equal:
+		return "equal"
+	}
+	return "not_equal"
+}
+
+func emitFileChecked(mirrorId, node string, record testRecord) {
+	emitEvent(&event{
+		Type:     eventFileChecked,
+		Mirror:   mirrorId,
+		Node:     node,
+		File:     record.standard.FilePath,
+		Status:   recordStatus(record),
+		ErrClass: classifyError(record.err),
+		Latency:  int64(record.latency / time.Millisecond),
+	})
+}
+
+func emitMirrorDone(mirrorId string, results []*testResult, duration time.Duration, resumed bool) {
+	e := &event{
+		Type:     eventMirrorDone,
+		Mirror:   mirrorId,
+		Duration: int64(duration / time.Millisecond),
+		Resumed:  resumed,
+	}
+	// CDN 取最低的进度
+	for i, tr := range results {
+		if i == 0 || tr.percent < e.Percent {
+			e.Percent = tr.percent
+		}
+		e.NumErrs += tr.numErrs
+		e.Total += len(tr.records)
+		e.Vantage = tr.vantage
+	}
+	emitEvent(e)
+}
+
+// jsonEventWriter 把事件以 JSON lines 写入 w。
+type jsonEventWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func newJSONEventWriter(w io.Writer) *jsonEventWriter {
+	return &jsonEventWriter{w: w, enc: json.NewEncoder(w)}
+}
+
+func (jw *jsonEventWriter) handleEvent(e *event) {
+	jw.mu.Lock()
+	err := jw.enc.Encode(e)
+	jw.mu.Unlock()
+	if err != nil {
+		log.Println("WARN: events:", err)
+	}
+}
+
+// startEvents 按 -events 和 -tui 设置事件的输出，返回结束时调用的函数，
+// 这个函数可以调用多次。
+func startEvents() (stop func(), err error) {
+	var stops []func()
+	if optEvents != "" {
+		w := io.Writer(os.Stdout)
+		if optEvents != "-" {
+			f, err := os.OpenFile(optEvents, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, err
+			}
+			stops = append(stops, func() { f.Close() })
+			w = f
+		}
+		addEventHandler(newJSONEventWriter(w))
+	}
+	if optTUI {
+		ui, err := startTUI(os.Stderr, optTUILog)
+		if err != nil {
+			return nil, err
+		}
+		if ui != nil {
+			addEventHandler(ui)
+			// 先停止 TUI，日志恢复输出到终端
+			stops = append([]func(){ui.stop}, stops...)
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, stop := range stops {
+				stop()
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// filterRule 决定一个文件是否参与检测。规则按顺序匹配，第一个匹配的规则生效，
+// 都不匹配时参与检测。
+type filterRule struct {
+	Name string `json:"name"`
+	// include 或 exclude
+	Action string `json:"action"`
+	// Glob 中 * 不匹配 /，** 匹配任意字符
+	Glob  string `json:"glob,omitempty"`
+	Regex string `json:"regex,omitempty"`
+	// 为空时匹配所有架构，源码包的架构是 source
+	Archs []string `json:"archs,omitempty"`
+	// deb, udeb, dsc, orig, debian, other，为空时匹配所有类型
+	FileTypes []string `json:"fileTypes,omitempty"`
+
+	reg *regexp.Regexp
+}
+
+// defaultFilterRules 和以前写死在 ignoreFile 中的行为一致。
+var defaultFilterRules = []*filterRule{
+	{Name: "guard", Action: "exclude", Regex: "__GUARD__"},
+	{Name: "diff-index", Action: "exclude", Regex: `/(Sources|Packages)\.diff/`},
+	{Name: "i386", Action: "exclude", Glob: "pool/**", Archs: []string{"i386"}},
+	{Name: "pool-deb", Action: "include", Glob: "pool/**", FileTypes: []string{"deb"}},
+	{Name: "pool-other", Action: "exclude", Glob: "pool/**"},
+}
+
+func (r *filterRule) compile() error {
+	if r.Action != "include" && r.Action != "exclude" {
+		return fmt.Errorf("filter rule %q: invalid action %q", r.Name, r.Action)
+	}
+	if r.Glob != "" && r.Regex != "" {
+		return fmt.Errorf("filter rule %q: glob and regex are exclusive", r.Name)
+	}
+
+	var expr string
+	if r.Glob != "" {
+		expr = globToRegexp(r.Glob)
+	} else if r.Regex != "" {
+		expr = r.Regex
+	} else {
+		expr = ".*"
+	}
+	var err error
+	r.reg, err = regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("filter rule %q: %v", r.Name, err)
+	}
+	return nil
+}
+
+func globToRegexp(glob string) string {
+	var buf strings.Builder
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				buf.WriteString(".*")
+				i++
+			} else {
+				buf.WriteString("[^/]*")
+			}
+		case '?':
+			buf.WriteString("[^/]")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
+
+func (r *filterRule) match(filename, arch, fileType string) bool {
+	if len(r.Archs) > 0 && !containsString(r.Archs, arch) {
+		return false
+	}
+	if len(r.FileTypes) > 0 && !containsString(r.FileTypes, fileType) {
+		return false
+	}
+	return r.reg.MatchString(filename)
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+func getFileType(filename string) string {
+	base := path.Base(filename)
+	switch {
+	case strings.HasSuffix(base, ".deb"):
+		return "deb"
+	case strings.HasSuffix(base, ".udeb"):
+		return "udeb"
+	case strings.HasSuffix(base, ".dsc"):
+		return "dsc"
+	case strings.Contains(base, ".orig.tar."), strings.Contains(base, ".orig-"):
+		return "orig"
+	case strings.Contains(base, ".debian.tar."), strings.HasSuffix(base, ".diff.gz"):
+		return "debian"
+	}
+	return "other"
+}
+
+type fileFilter struct {
+	rules []*filterRule
+
+	mu         sync.Mutex
+	numMatched []int // 按规则的下标，规则可以没有名字或者重名
+	numDefault int
+}
+
+func newFileFilter(rules []*filterRule) (*fileFilter, error) {
+	for _, r := range rules {
+		err := r.compile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &fileFilter{
+		rules:      rules,
+		numMatched: make([]int, len(rules)),
+	}, nil
+}
+
+// loadFileFilter 从 JSON 文件加载规则，文件内容是仓库名到规则列表的映射，
+// 例如 {"deepin": [{"name": "arm64", "action": "exclude", "archs": ["arm64"]}]}。
+// filename 为空或者没有配置仓库时使用默认规则。
+func loadFileFilter(filename, repo string) (*fileFilter, error) {
+	if filename == "" {
+		return newFileFilter(defaultFilterRules)
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var repoRules map[string][]*filterRule
+	err = json.Unmarshal(data, &repoRules)
+	if err != nil {
+		return nil, err
+	}
+	rules, ok := repoRules[repo]
+	if !ok {
+		return newFileFilter(defaultFilterRules)
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("loadFileFilter: no rule for repository " + repo)
+	}
+	return newFileFilter(rules)
+}
+
+// ignore 返回 true 表示不检测这个文件，同时统计每个规则匹配的文件数。
+func (f *fileFilter) ignore(filename string) bool {
+	fileType := getFileType(filename)
+	var arch string
+	if strings.HasPrefix(filename, "pool/") {
+		_, _, arch = parseDebPath(filename)
+	}
+
+	for i, r := range f.rules {
+		if r.match(filename, arch, fileType) {
+			f.mu.Lock()
+			f.numMatched[i]++
+			f.mu.Unlock()
+			return r.Action == "exclude"
+		}
+	}
+
+	f.mu.Lock()
+	f.numDefault++
+	f.mu.Unlock()
+	return false
+}
+
+// reset 清零匹配的文件数，每次获取快照前调用。
+func (f *fileFilter) reset() {
+	f.mu.Lock()
+	for i := range f.numMatched {
+		f.numMatched[i] = 0
+	}
+	f.numDefault = 0
+	f.mu.Unlock()
+}
+
+func (f *fileFilter) save() error {
+	err := makeResultDir()
+	if err != nil {
+		return err
+	}
+
+	fh, err := os.Create(filepath.Join("result", "filter-rules.txt"))
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	bw := bufio.NewWriter(fh)
+
+	f.mu.Lock()
+	for i, r := range f.rules {
+		fmt.Fprintf(bw, "%s %s: %d\n", r.Action, r.Name, f.numMatched[i])
+	}
+	fmt.Fprintf(bw, "include (no rule matched): %d\n", f.numDefault)
+	f.mu.Unlock()
+
+	return bw.Flush()
+}
+
+var fileFilterRules *fileFilter
+
+func ignoreFile(filename string) bool {
+	return fileFilterRules.ignore(filename)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// geoIPDB 从 CSV 格式的 IP 地址库查询 IP 所在国家，每行是 起始地址,结束地址,国家代码[,...]，
+// 地址可以是 IPv4/IPv6 文本（DB-IP country lite）或者十进制整数（IP2Location LITE DB1）。
+type geoIPDB struct {
+	ranges []geoIPRange
+}
+
+type geoIPRange struct {
+	start   net.IP // 16 字节
+	end     net.IP
+	country string
+}
+
+func parseGeoIPAddr(s string) (net.IP, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.To16(), nil
+	}
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return nil, fmt.Errorf("invalid ip address %q", s)
+	}
+	b := n.Bytes()
+	if n.BitLen() <= 32 {
+		ip := make(net.IP, 4)
+		copy(ip[4-len(b):], b)
+		return ip.To16(), nil
+	}
+	ip := make(net.IP, 16)
+	copy(ip[16-len(b):], b)
+	return ip, nil
+}
+
+func loadGeoIPDB(filename string) (*geoIPDB, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	db := &geoIPDB{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if len(record) < 3 {
+			continue
+		}
+		start, err := parseGeoIPAddr(strings.TrimSpace(record[0]))
+		if err != nil {
+			// 表头
+			continue
+		}
+		end, err := parseGeoIPAddr(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		country := strings.ToUpper(strings.TrimSpace(record[2]))
+		if country == "" || country == "-" || country == "ZZ" {
+			continue
+		}
+		db.ranges = append(db.ranges, geoIPRange{start: start, end: end, country: country})
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start, db.ranges[j].start) < 0
+	})
+	return db, nil
+}
+
+// lookup 返回 ip 所在国家的代码，找不到时返回空字符串。
+func (db *geoIPDB) lookup(ip net.IP) string {
+	if db == nil || ip == nil {
+		return ""
+	}
+	ip = ip.To16()
+	// 第一个起始地址大于 ip 的范围的前一个
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start, ip) > 0
+	})
+	if i == 0 {
+		return ""
+	}
+	r := db.ranges[i-1]
+	if bytes.Compare(ip, r.end) <= 0 {
+		return r.country
+	}
+	return ""
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"mirror_status/sink"
+)
+
+// 历史结果保存在 bbolt 数据库中：
+//
+//	runs                      run id -> historyRun
+//	mirrors/<mirror id>       run id[/cdn node] -> historyMirrorResult
+//	files/<mirror id>         run id/file path -> historyFileRecord
+//	file_state/<mirror id>    file path -> historyFileState，文件最近一次不一致从什么时候开始
+//
+// run id 按时间排序，按保留时间删除旧数据时可以按前缀范围删除。
+
+var (
+	bucketRuns      = []byte("runs")
+	bucketMirrors   = []byte("mirrors")
+	bucketFiles     = []byte("files")
+	bucketFileState = []byte("file_state")
+)
+
+type historyRun struct {
+	Id           string    `json:"id"`
+	StartTime    time.Time `json:"startTime"`
+	EndTime      time.Time `json:"endTime"`
+	SnapshotHash string    `json:"snapshotHash"`
+	NumMirrors   int       `json:"numMirrors"`
+}
+
+type historyMirrorResult struct {
+	RunId          string        `json:"runId"`
+	Time           time.Time     `json:"time"`
+	UrlPrefix      string        `json:"urlPrefix"`
+	CdnNodeAddress string        `json:"cdnNodeAddress,omitempty"`
+	Percent        float64       `json:"percent"`
+	NumErrs        int           `json:"numErrs"`
+	NumFiles       int           `json:"numFiles"`
+	Latency        time.Duration `json:"latency"`
+}
+
+const (
+	fileStatusEqual    = "equal"
+	fileStatusNotEqual = "not_equal"
+	fileStatusError    = "error"
+)
+
+type historyFileRecord struct {
+	Status   string `json:"status"`
+	ErrClass string `json:"errClass,omitempty"`
+}
+
+type historyFileState struct {
+	Status       string    `json:"status"`
+	LastRunId    string    `json:"lastRunId"`
+	LastTime     time.Time `json:"lastTime"`
+	BadSinceRun  string    `json:"badSinceRun,omitempty"`
+	BadSinceTime time.Time `json:"badSinceTime,omitempty"`
+}
+
+func getRecordStatus(record testRecord) string {
+	if record.err != nil {
+		return fileStatusError
+	}
+	if record.equal {
+		return fileStatusEqual
+	}
+	return fileStatusNotEqual
+}
+
+func openHistoryDB(filename string, readOnly bool) (*bolt.DB, error) {
+	return bolt.Open(filename, 0644, &bolt.Options{
+		Timeout:  10 * time.Second,
+		ReadOnly: readOnly,
+	})
+}
+
+func putJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// recordHistory 把一次检测的结果写入历史数据库，并删除超过保留时间的数据。
+func recordHistory(filename string, run *checkRun, retention time.Duration) error {
+	db, err := openHistoryDB(filename, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		runs, err := tx.CreateBucketIfNotExists(bucketRuns)
+		if err != nil {
+			return err
+		}
+		hr := historyRun{
+			Id:         run.id,
+			StartTime:  run.startTime,
+			EndTime:    run.endTime,
+			NumMirrors: len(run.mirrors),
+		}
+		if run.snapshot != nil {
+			hr.SnapshotHash = run.snapshot.Hash
+		}
+		err = putJSON(runs, run.id, hr)
+		if err != nil {
+			return err
+		}
+
+		// CDN 的各个节点一起记录，上游不是镜像
+		var names []string
+		byName := make(map[string][]*testResult)
+		for _, tr := range run.testResults {
+			if tr.upstream || tr.urlPrefix == "" {
+				continue
+			}
+			if _, ok := byName[tr.name]; !ok {
+				names = append(names, tr.name)
+			}
+			byName[tr.name] = append(byName[tr.name], tr)
+		}
+		for _, name := range names {
+			err = recordMirrorHistory(tx, run, name, byName[name])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if retention > 0 {
+		return db.Update(func(tx *bolt.Tx) error {
+			return deleteHistoryBefore(tx, time.Now().Add(-retention))
+		})
+	}
+	return nil
+}
+
+func recordMirrorHistory(tx *bolt.Tx, run *checkRun, name string, results []*testResult) error {
+	mirrorsBucket, err := createNestedBucket(tx, bucketMirrors, name)
+	if err != nil {
+		return err
+	}
+	// CDN 各节点的文件记录合并在一起，任一节点不一致就认为不一致
+	var filePaths []string
+	records := make(map[string]testRecord)
+	for _, tr := range results {
+		key := run.id
+		if tr.cdnNodeAddress != "" {
+			key += "/" + tr.cdnNodeAddress
+		}
+		err = putJSON(mirrorsBucket, key, historyMirrorResult{
+			RunId:          run.id,
+			Time:           run.startTime,
+			UrlPrefix:      tr.urlPrefix,
+			CdnNodeAddress: tr.cdnNodeAddress,
+			Percent:        tr.percent,
+			NumErrs:        tr.numErrs,
+			NumFiles:       len(tr.records),
+			Latency:        tr.avgLatency(),
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, record := range tr.records {
+			filePath := record.standard.FilePath
+			old, ok := records[filePath]
+			if !ok {
+				filePaths = append(filePaths, filePath)
+			} else if getRecordStatus(old) != fileStatusEqual {
+				continue
+			}
+			records[filePath] = record
+		}
+	}
+
+	filesBucket, err := createNestedBucket(tx, bucketFiles, name)
+	if err != nil {
+		return err
+	}
+	stateBucket, err := createNestedBucket(tx, bucketFileState, name)
+	if err != nil {
+		return err
+	}
+	for _, filePath := range filePaths {
+		record := records[filePath]
+		status := getRecordStatus(record)
+		err = putJSON(filesBucket, run.id+"/"+filePath, historyFileRecord{
+			Status:   status,
+			ErrClass: classifyError(record.err),
+		})
+		if err != nil {
+			return err
+		}
+
+		var state historyFileState
+		if data := stateBucket.Get([]byte(filePath)); data != nil {
+			err = json.Unmarshal(data, &state)
+			if err != nil {
+				return err
+			}
+		}
+		state.Status = status
+		state.LastRunId = run.id
+		state.LastTime = run.startTime
+		if status == fileStatusEqual {
+			state.BadSinceRun = ""
+			state.BadSinceTime = time.Time{}
+		} else if state.BadSinceRun == "" {
+			state.BadSinceRun = run.id
+			state.BadSinceTime = run.startTime
+		}
+		err = putJSON(stateBucket, filePath, state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createNestedBucket(tx *bolt.Tx, parent []byte, name string) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists(parent)
+	if err != nil {
+		return nil, err
+	}
+	return b.CreateBucketIfNotExists([]byte(name))
+}
+
+// deleteHistoryBefore 删除 t 之前开始的检测的所有数据，
+// 以及 t 之前最后一次检测到的文件状态。
+func deleteHistoryBefore(tx *bolt.Tx, t time.Time) error {
+	minKey := []byte(sink.RunId(t))
+
+	// 在游标遍历中删除会跳过下一个 key，先收集再删除
+	deleteKeys := func(b *bolt.Bucket, keys [][]byte) error {
+		for _, k := range keys {
+			err := b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	deleteBefore := func(b *bolt.Bucket) error {
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, minKey) < 0; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return deleteKeys(b, keys)
+	}
+
+	if runs := tx.Bucket(bucketRuns); runs != nil {
+		err := deleteBefore(runs)
+		if err != nil {
+			return err
+		}
+	}
+	for _, parent := range [][]byte{bucketMirrors, bucketFiles} {
+		pb := tx.Bucket(parent)
+		if pb == nil {
+			continue
+		}
+		err := pb.ForEach(func(name, _ []byte) error {
+			return deleteBefore(pb.Bucket(name))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if pb := tx.Bucket(bucketFileState); pb != nil {
+		return pb.ForEach(func(name, _ []byte) error {
+			b := pb.Bucket(name)
+			var keys [][]byte
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				var state historyFileState
+				err := json.Unmarshal(v, &state)
+				if err != nil {
+					return err
+				}
+				if state.LastTime.Before(t) {
+					keys = append(keys, append([]byte(nil), k...))
+				}
+			}
+			return deleteKeys(b, keys)
+		})
+	}
+	return nil
+}
+
+func recordHistoryIfNeeded(run *checkRun) {
+	if optHistoryDB == "" {
+		return
+	}
+	err := recordHistory(optHistoryDB, run, optHistoryRetention)
+	if err != nil {
+		log.Println("WARN: record history:", err)
+	}
+}
+
+// historyMain 实现 history 子命令，查询历史数据库。
+func historyMain(args []string) {
+	if len(args) == 0 {
+		historyUsage()
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet("history "+cmd, flag.ExitOnError)
+	var days int
+	var num int
+	fs.IntVar(&days, "days", 30, "number of days to show")
+	fs.IntVar(&num, "n", 20, "number of files to show")
+	fs.Parse(args[1:])
+
+	db, err := openHistoryDB(optHistoryDB, true)
+	if err != nil {
+		fatal(err)
+	}
+	defer db.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	switch cmd {
+	case "runs":
+		err = historyRuns(db, w, days)
+	case "progress":
+		err = historyProgress(db, w, fs.Arg(0), days)
+	case "last-sync":
+		err = historyLastSync(db, w, fs.Arg(0))
+	case "missing":
+		err = historyMissing(db, w, fs.Arg(0), num)
+	default:
+		historyUsage()
+	}
+	if err != nil {
+		w.Flush()
+		fatal(err)
+	}
+}
+
+func historyUsage() {
+	fmt.Fprintln(os.Stderr, `usage: cdn-check [-history-db FILE] history COMMAND [flags] [ARG]
+
+commands:
+  runs [-days 30]                   list runs
+  progress [-days 30] MIRROR        progress of a mirror in every run
+  last-sync MIRROR                  the last run in which the mirror was 100% in sync
+  missing [-n 20] [MIRROR]          files out of sync for the longest time`)
+	os.Exit(2)
+}
+
+func historyRuns(db *bolt.DB, w *tabwriter.Writer, days int) error {
+	minKey := []byte(sink.RunId(time.Now().AddDate(0, 0, -days)))
+	fmt.Fprintln(w, "RUN\tSTART\tDURATION\tMIRRORS\tSNAPSHOT")
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRuns)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(minKey); k != nil; k, v = c.Next() {
+			var hr historyRun
+			err := json.Unmarshal(v, &hr)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%s\t%v\t%d\t%.12s\n", hr.Id,
+				hr.StartTime.Format("2006-01-02 15:04"),
+				hr.EndTime.Sub(hr.StartTime).Round(time.Second),
+				hr.NumMirrors, hr.SnapshotHash)
+		}
+		return nil
+	})
+}
+
+func getMirrorHistoryBucket(tx *bolt.Tx, mirrorId string) (*bolt.Bucket, error) {
+	if mirrorId == "" {
+		return nil, errors.New("mirror id is required")
+	}
+	pb := tx.Bucket(bucketMirrors)
+	if pb == nil {
+		return nil, errors.New("no history")
+	}
+	b := pb.Bucket([]byte(mirrorId))
+	if b == nil {
+		return nil, errors.New("no history of mirror " + mirrorId)
+	}
+	return b, nil
+}
+
+func historyProgress(db *bolt.DB, w *tabwriter.Writer, mirrorId string, days int) error {
+	minKey := []byte(sink.RunId(time.Now().AddDate(0, 0, -days)))
+	fmt.Fprintln(w, "RUN\tTIME\tNODE\tPROGRESS\tERRORS\tFILES\tLATENCY")
+	return db.View(func(tx *bolt.Tx) error {
+		b, err := getMirrorHistoryBucket(tx, mirrorId)
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(minKey); k != nil; k, v = c.Next() {
+			var r historyMirrorResult
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%.3f%%\t%d\t%d\t%v\n", r.RunId,
+				r.Time.Format("2006-01-02 15:04"), r.CdnNodeAddress, r.Percent,
+				r.NumErrs, r.NumFiles, r.Latency.Round(time.Millisecond))
+		}
+		return nil
+	})
+}
+
+func historyLastSync(db *bolt.DB, w *tabwriter.Writer, mirrorId string) error {
+	return db.View(func(tx *bolt.Tx) error {
+		b, err := getMirrorHistoryBucket(tx, mirrorId)
+		if err != nil {
+			return err
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var r historyMirrorResult
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+			if r.Percent == 100 {
+				fmt.Fprintf(w, "%s was 100%% in sync in run %s at %s (%v ago)\n",
+					mirrorId, r.RunId, r.Time.Format("2006-01-02 15:04"),
+					time.Since(r.Time).Round(time.Minute))
+				return nil
+			}
+		}
+		fmt.Fprintf(w, "%s has never been 100%% in sync in the history\n", mirrorId)
+		return nil
+	})
+}
+
+type missingFile struct {
+	mirrorId string
+	filePath string
+	state    historyFileState
+}
+
+// lastMirrorRunId 返回镜像最后一次检测的 id，没有记录时返回空字符串。
+func lastMirrorRunId(tx *bolt.Tx, mirrorId string) (string, error) {
+	b := tx.Bucket(bucketMirrors)
+	if b != nil {
+		b = b.Bucket([]byte(mirrorId))
+	}
+	if b == nil {
+		return "", nil
+	}
+	_, v := b.Cursor().Last()
+	if v == nil {
+		return "", nil
+	}
+	var r historyMirrorResult
+	err := json.Unmarshal(v, &r)
+	if err != nil {
+		return "", err
+	}
+	return r.RunId, nil
+}
+
+// historyMissing 列出镜像最后一次检测中仍然不一致的文件。文件是随机抽样的，
+// 之前不一致、最后一次检测没有抽到的文件状态可能已经过时，不列出。
+func historyMissing(db *bolt.DB, w *tabwriter.Writer, mirrorId string, num int) error {
+	var files []missingFile
+	err := db.View(func(tx *bolt.Tx) error {
+		pb := tx.Bucket(bucketFileState)
+		if pb == nil {
+			return nil
+		}
+		return pb.ForEach(func(name, _ []byte) error {
+			if mirrorId != "" && string(name) != mirrorId {
+				return nil
+			}
+			lastRunId, err := lastMirrorRunId(tx, string(name))
+			if err != nil {
+				return err
+			}
+			return pb.Bucket(name).ForEach(func(k, v []byte) error {
+				var state historyFileState
+				err := json.Unmarshal(v, &state)
+				if err != nil {
+					return err
+				}
+				if state.BadSinceRun != "" && state.LastRunId == lastRunId {
+					files = append(files, missingFile{
+						mirrorId: string(name),
+						filePath: string(k),
+						state:    state,
+					})
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].state.BadSinceTime.Before(files[j].state.BadSinceTime)
+	})
+	if num > 0 && len(files) > num {
+		files = files[:num]
+	}
+	fmt.Fprintln(w, "MIRROR\tSINCE\tLAST SEEN\tSTATUS\tFILE")
+	for _, f := range files {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.mirrorId,
+			f.state.BadSinceTime.Format("2006-01-02 15:04"),
+			f.state.LastTime.Format("2006-01-02 15:04"),
+			strings.Replace(f.state.Status, "_", " ", -1), f.filePath)
+	}
+	return nil
+}
@@ -1,52 +1,14 @@
 package main
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/influxdata/influxdb/client/v2"
-)
-
-type InfluxClient struct {
-	c      client.Client
-	dbname string
-}
 
-func (c *InfluxClient) Write(ps ...*client.Point) error {
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database: c.dbname,
-	})
-	if err != nil {
-		return err
-	}
-	for _, p := range ps {
-		bp.AddPoint(p)
-	}
-	return c.c.Write(bp)
-}
-
-func (c *InfluxClient) Close() error { return c.c.Close() }
-
-func NewInfluxClient(addr string, user string, passwd string, dbname string) (*InfluxClient, error) {
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:     addr,
-		Username: user,
-		Password: passwd,
-	})
-	if err != nil {
-		return nil, err
-	}
-	_, _, err = c.Ping(time.Second)
-	if err != nil {
-		return nil, err
-	}
-	_, err = c.Query(client.Query{
-		Command: fmt.Sprintf("create database %s", dbname),
-	})
-	return &InfluxClient{c, dbname}, err
-}
+	"mirror_status/sink"
+)
 
-func pushToMirrors(c *InfluxClient, points []mirrorsPoint, t time.Time) error {
+func pushToMirrors(c sink.Sink, points []mirrorsPoint, t time.Time) error {
 	var cPoints []*client.Point
 	for _, p := range points {
 		point, err := client.NewPoint(
@@ -68,7 +30,7 @@ func pushToMirrors(c *InfluxClient, points []mirrorsPoint, t time.Time) error {
 	return c.Write(cPoints...)
 }
 
-func pushToMirrorsCdn(c *InfluxClient, points []mirrorsCdnPoint, t time.Time) error {
+func pushToMirrorsCdn(c sink.Sink, points []mirrorsCdnPoint, t time.Time) error {
 	var cPoints []*client.Point
 	for _, p := range points {
 		point, err := client.NewPoint(
@@ -90,13 +52,115 @@ func pushToMirrorsCdn(c *InfluxClient, points []mirrorsCdnPoint, t time.Time) er
 	return c.Write(cPoints...)
 }
 
+func pushToUpstream(c sink.Sink, points []upstreamPoint, t time.Time) error {
+	var cPoints []*client.Point
+	for _, p := range points {
+		point, err := client.NewPoint(
+			"upstream",
+			map[string]string{
+				"url":    p.Url,
+				"run_id": p.RunId,
+			},
+			map[string]interface{}{
+				"coverage":  p.Coverage,
+				"num_errs":  p.NumErrs,
+				"num_files": p.NumFiles,
+			},
+			t)
+		if err != nil {
+			panic(err)
+		}
+
+		cPoints = append(cPoints, point)
+	}
+	return c.Write(cPoints...)
+}
+
+func pushToMirrorsV2(c sink.Sink, points []mirrorsPoint, t time.Time) error {
+	var cPoints []*client.Point
+	for _, p := range points {
+		point, err := client.NewPoint(
+			sink.MeasurementMirrors,
+			p.Tags.Map(),
+			p.fieldsV2(),
+			t)
+		if err != nil {
+			panic(err)
+		}
+
+		cPoints = append(cPoints, point)
+	}
+	return c.Write(cPoints...)
+}
+
+func pushToMirrorsCdnV2(c sink.Sink, points []mirrorsCdnPoint, t time.Time) error {
+	var cPoints []*client.Point
+	for _, p := range points {
+		point, err := client.NewPoint(
+			sink.MeasurementMirrorsCdn,
+			p.Tags.Map(),
+			p.fieldsV2(),
+			t)
+		if err != nil {
+			panic(err)
+		}
+
+		cPoints = append(cPoints, point)
+	}
+	return c.Write(cPoints...)
+}
+
 type mirrorsPoint struct {
 	Name     string
 	Progress float64
+
+	// 以下字段只用于第 2 版
+	Tags        sink.MirrorTags
+	Latency     time.Duration
+	NumErrs     int
+	NumFiles    int
+	RunDuration time.Duration
+}
+
+func (p *mirrorsPoint) fieldsV2() map[string]interface{} {
+	return map[string]interface{}{
+		"progress":       p.Progress,
+		"latency":        p.Latency.Seconds() * 1000,
+		"num_errs":       p.NumErrs,
+		"num_files":      p.NumFiles,
+		"run_duration":   p.RunDuration.Seconds(),
+		"schema_version": sink.SchemaVersion,
+	}
 }
 
 type mirrorsCdnPoint struct {
 	MirrorId   string
 	NodeIpAddr string
 	Progress   float64
+
+	// 以下字段只用于第 2 版
+	Tags        sink.MirrorTags
+	Latency     time.Duration
+	NumErrs     int
+	NumFiles    int
+	RunDuration time.Duration
+}
+
+func (p *mirrorsCdnPoint) fieldsV2() map[string]interface{} {
+	return map[string]interface{}{
+		"progress":       p.Progress,
+		"latency":        p.Latency.Seconds() * 1000,
+		"num_errs":       p.NumErrs,
+		"num_files":      p.NumFiles,
+		"run_duration":   p.RunDuration.Seconds(),
+		"schema_version": sink.SchemaVersion,
+	}
+}
+
+type upstreamPoint struct {
+	Url      string
+	RunId    string
+	Coverage float64
+	NumErrs  int
+	NumFiles int
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// runJournal 在检测过程中把每个文件的结果追加到 -journal 文件，一行一个 JSON：
+//
+//	{"type":"run","run":{...}}                            检测的 id、开始时间、快照和随机种子
+//	{"type":"record","mirror":"id","node":"ip","record":{...}}  一个文件的结果，node 是 CDN 节点
+//	{"type":"mirror","mirror":"id","results":[...]}         镜像检测完成
+//
+// 检测被中断后用 -resume 继续：使用同一个 id 和快照（也就是同样的文件列表和随机种子），
+// 跳过已经检测完成的镜像和文件。检测正常结束后删除 journal。
+type runJournal struct {
+	filename string
+
+	mu       sync.Mutex
+	f        *os.File
+	run      *journalRun                      // 继续的检测，新的检测为 nil
+	records  map[string]map[string]testRecord // 镜像 id 和节点 -> 文件 -> 结果
+	finished map[string][]*testResult
+}
+
+type journalRun struct {
+	Id           string    `json:"id"`
+	StartTime    time.Time `json:"startTime"`
+	SnapshotHash string    `json:"snapshotHash"`
+	Seed         int64     `json:"seed"`
+}
+
+type journalEntry struct {
+	Type    string            `json:"type"`
+	Run     *journalRun       `json:"run,omitempty"`
+	Mirror  string            `json:"mirror,omitempty"`
+	Node    string            `json:"node,omitempty"`
+	Record  *testRecordJSON   `json:"record,omitempty"`
+	Results []*testResultJSON `json:"results,omitempty"`
+}
+
+// activeJournal 是本次检测的 journal，没有启用时为 nil，nil 的 journal 上的操作什么都不做。
+var activeJournal *runJournal
+
+func journalKey(mirrorId, node string) string {
+	return mirrorId + "/" + node
+}
+
+// loadRunJournal 创建 journal，resume 时加载 filename 中中断的检测，文件不存在时开始新的检测。
+func loadRunJournal(filename string, resume bool) (*runJournal, error) {
+	j := &runJournal{
+		filename: filename,
+		records:  make(map[string]map[string]testRecord),
+		finished: make(map[string][]*testResult),
+	}
+	if !resume {
+		return j, nil
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		log.Println("no journal to resume, start a new run")
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for lineNum := 1; ; lineNum++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// 进程被杀死时最后一行可能不完整
+			log.Printf("WARN: %s:%d: %v\n", filename, lineNum, err)
+			continue
+		}
+		j.load(&entry)
+	}
+	if j.run == nil {
+		log.Println("journal has no run, start a new run")
+		return j, nil
+	}
+	log.Printf("resume run %s, %d mirrors finished\n", j.run.Id, len(j.finished))
+	return j, nil
+}
+
+func (j *runJournal) load(entry *journalEntry) {
+	switch entry.Type {
+	case "run":
+		j.run = entry.Run
+	case "record":
+		if entry.Record == nil || entry.Record.Standard == nil {
+			return
+		}
+		key := journalKey(entry.Mirror, entry.Node)
+		records := j.records[key]
+		if records == nil {
+			records = make(map[string]testRecord)
+			j.records[key] = records
+		}
+		records[entry.Record.Standard.FilePath] = entry.Record.toTestRecord()
+	case "mirror":
+		var results []*testResult
+		for _, trv := range entry.Results {
+			results = append(results, trv.toTestResult())
+		}
+		j.finished[entry.Mirror] = results
+	}
+}
+
+// snapshotFile 返回继续的检测使用的快照文件，新的检测返回空字符串。
+func (j *runJournal) snapshotFile(snapshotDir string) string {
+	if j == nil || j.run == nil {
+		return ""
+	}
+	return filepath.Join(snapshotDir, "snapshot-"+j.run.SnapshotHash+".json")
+}
+
+// begin 开始记录 run，继续的检测沿用原来的 id 和开始时间。
+func (j *runJournal) begin(run *checkRun) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.run != nil {
+		if run.snapshot.Hash != j.run.SnapshotHash {
+			return fmt.Errorf("snapshot %s of the run differs from %s in the journal",
+				run.snapshot.Hash, j.run.SnapshotHash)
+		}
+		run.id = j.run.Id
+		run.startTime = j.run.StartTime
+		f, err := os.OpenFile(j.filename, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		j.f = f
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(j.filename), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(j.filename)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	j.run = &journalRun{
+		Id:           run.id,
+		StartTime:    run.startTime,
+		SnapshotHash: run.snapshot.Hash,
+		Seed:         run.snapshot.Seed,
+	}
+	return j.write(&journalEntry{Type: "run", Run: j.run})
+}
+
+// write 追加一行，调用时持有 j.mu。
+func (j *runJournal) write(entry *journalEntry) error {
+	if j.f == nil {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = j.f.Write(append(data, '\n'))
+	return err
+}
+
+// addRecord 记录镜像 mirrorId 的一个文件的结果，node 是 CDN 节点的地址，普通镜像为空。
+func (j *runJournal) addRecord(mirrorId, node string, record testRecord) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	err := j.write(&journalEntry{
+		Type:   "record",
+		Mirror: mirrorId,
+		Node:   node,
+		Record: newTestRecordJSON(record),
+	})
+	j.mu.Unlock()
+	if err != nil {
+		log.Println("WARN: journal:", err)
+	}
+}
+
+// resumeRecords 返回 journal 中已经检测过的文件的结果和还需要检测的文件。
+func (j *runJournal) resumeRecords(mirrorId, node string,
+	validateInfoList []*FileValidateInfo) ([]testRecord, []*FileValidateInfo) {
+	if j == nil {
+		return nil, validateInfoList
+	}
+	j.mu.Lock()
+	done := j.records[journalKey(mirrorId, node)]
+	j.mu.Unlock()
+	if len(done) == 0 {
+		return nil, validateInfoList
+	}
+
+	var records []testRecord
+	var todo []*FileValidateInfo
+	for _, vi := range validateInfoList {
+		if record, ok := done[vi.FilePath]; ok {
+			record.standard = vi
+			records = append(records, record)
+		} else {
+			todo = append(todo, vi)
+		}
+	}
+	name := mirrorId
+	if node != "" {
+		name += " " + node
+	}
+	log.Printf("resume mirror %s, %d files checked before\n", name, len(records))
+	return records, todo
+}
+
+// finishMirror 记录镜像检测完成。
+func (j *runJournal) finishMirror(mirrorId string, results []*testResult) {
+	if j == nil {
+		return
+	}
+	entry := &journalEntry{Type: "mirror", Mirror: mirrorId}
+	for _, tr := range results {
+		entry.Results = append(entry.Results, tr.toJSON(true))
+	}
+	j.mu.Lock()
+	err := j.write(entry)
+	j.mu.Unlock()
+	if err != nil {
+		log.Println("WARN: journal:", err)
+	}
+}
+
+// getFinished 返回上次已经检测完成的镜像的结果，没有时返回 nil。
+func (j *runJournal) getFinished(mirrorId string) []*testResult {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.finished[mirrorId]
+}
+
+// remove 在检测正常结束后删除 journal。
+func (j *runJournal) remove() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+	err := os.Remove(j.filename)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("WARN: journal:", err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 分级的结构化日志。每条日志有级别、消息和 key=value 字段（mirror_id、url、attempt、err_class 等），
+// -log-format 为 text 或 json，低于 -log-level 的日志不输出，逐个 URL 的跟踪是 debug 级别。
+// -mirror-logs 时每个镜像的日志另外写入 result/<id>.log（和 result/<id>.txt 在一起），
+// 级别为 -mirror-log-level。
+//
+// 标准库 log 的输出也经过这里：以 "WARN:" 开头的是 warn，以 "ERROR:" 开头的是 error，其他是 info。
+// 退出程序使用 fatal 和 fatalf，它们的日志是 error 级别，不会被 -log-level 过滤掉。
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("invalid log level %q", s)
+}
+
+var logConfig = struct {
+	mu          sync.Mutex
+	w           io.Writer
+	level       logLevel
+	json        bool
+	mirrorLevel logLevel
+}{w: os.Stderr, level: levelInfo, mirrorLevel: levelDebug}
+
+// logger 带有一组字段，out 不为 nil 时日志另外写入镜像的日志文件。
+type logger struct {
+	fields []interface{}
+	out    *mirrorLogFile
+}
+
+type mirrorLogFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// defaultLogger 是没有字段的 logger，nil 的 *logger 也使用它。
+var defaultLogger = &logger{}
+
+// initLogging 按 -log-level、-log-format 和 -mirror-log-level 设置日志，
+// 并让标准库 log 的输出经过结构化日志。
+func initLogging() error {
+	level, err := parseLogLevel(optLogLevel)
+	if err != nil {
+		return err
+	}
+	mirrorLevel, err := parseLogLevel(optMirrorLogLevel)
+	if err != nil {
+		return err
+	}
+	switch optLogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid log format %q", optLogFormat)
+	}
+	logConfig.mu.Lock()
+	logConfig.level = level
+	logConfig.mirrorLevel = mirrorLevel
+	logConfig.json = optLogFormat == "json"
+	logConfig.mu.Unlock()
+
+	log.SetFlags(log.Lshortfile)
+	log.SetOutput(stdLogWriter{})
+	return nil
+}
+
+// setLogOutput 修改日志的输出，返回原来的输出。
+func setLogOutput(w io.Writer) io.Writer {
+	logConfig.mu.Lock()
+	defer logConfig.mu.Unlock()
+	old := logConfig.w
+	logConfig.w = w
+	return old
+}
+
+// with 返回增加了字段的 logger。
+func (l *logger) with(kv ...interface{}) *logger {
+	if l == nil {
+		l = defaultLogger
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &logger{fields: fields, out: l.out}
+}
+
+// field 返回字段 key 的值，没有这个字段时返回空字符串。
+func (l *logger) field(key string) string {
+	if l == nil {
+		return ""
+	}
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		if l.fields[i] == key {
+			return fmt.Sprint(l.fields[i+1])
+		}
+	}
+	return ""
+}
+
+// newMirrorLogger 返回镜像的 logger，-mirror-logs 时打开 result/<id>.log。
+func newMirrorLogger(mirrorId string) *logger {
+	l := defaultLogger.with("mirror_id", mirrorId)
+	if !optMirrorLogs {
+		return l
+	}
+	err := makeResultDir()
+	if err == nil {
+		var f *os.File
+		f, err = os.Create(filepath.Join("result", mirrorId+".log"))
+		if err == nil {
+			l.out = &mirrorLogFile{f: f}
+		}
+	}
+	if err != nil {
+		l.warn("open mirror log", "err", err)
+	}
+	return l
+}
+
+// close 关闭镜像的日志文件。
+func (l *logger) close() {
+	if l == nil || l.out == nil {
+		return
+	}
+	l.out.mu.Lock()
+	l.out.f.Close()
+	l.out.mu.Unlock()
+}
+
+func (l *logger) debug(msg string, kv ...interface{}) { l.output(2, levelDebug, msg, kv) }
+func (l *logger) info(msg string, kv ...interface{})  { l.output(2, levelInfo, msg, kv) }
+func (l *logger) warn(msg string, kv ...interface{})  { l.output(2, levelWarn, msg, kv) }
+func (l *logger) error(msg string, kv ...interface{}) { l.output(2, levelError, msg, kv) }
+
+// fatal 和 log.Fatal 一样输出日志并退出，日志是 error 级别。
+func fatal(v ...interface{}) {
+	log.Output(2, "ERROR: "+fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+// fatalf 和 log.Fatalf 一样输出日志并退出，日志是 error 级别。
+func fatalf(format string, v ...interface{}) {
+	log.Output(2, "ERROR: "+fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+// output 中 depth 是调用 debug 等方法的位置相对于 output 的栈深度。
+func (l *logger) output(depth int, level logLevel, msg string, kv []interface{}) {
+	if l == nil {
+		l = defaultLogger
+	}
+	logConfig.mu.Lock()
+	toMain := level >= logConfig.level
+	toMirror := l.out != nil && level >= logConfig.mirrorLevel
+	jsonFormat := logConfig.json
+	logConfig.mu.Unlock()
+	if !toMain && !toMirror {
+		return
+	}
+
+	caller := ""
+	if _, file, line, ok := runtime.Caller(depth); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(kv)+2)
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	fields = append(fields, "caller", caller)
+	line := formatLogEntry(time.Now(), level, msg, fields, jsonFormat)
+
+	if toMain {
+		logConfig.mu.Lock()
+		logConfig.w.Write(line)
+		logConfig.mu.Unlock()
+	}
+	if toMirror {
+		l.out.mu.Lock()
+		l.out.f.Write(line)
+		l.out.mu.Unlock()
+	}
+}
+
+func logFieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func formatLogEntry(t time.Time, level logLevel, msg string, fields []interface{}, jsonFormat bool) []byte {
+	var buf bytes.Buffer
+	if jsonFormat {
+		buf.WriteString(`{"time":`)
+		writeJSONValue(&buf, t.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSONValue(&buf, strings.ToLower(level.String()))
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			buf.WriteByte(',')
+			writeJSONValue(&buf, fmt.Sprint(fields[i]))
+			buf.WriteByte(':')
+			writeJSONValue(&buf, logFieldValue(fields[i+1]))
+		}
+		buf.WriteString("}\n")
+		return buf.Bytes()
+	}
+
+	fmt.Fprintf(&buf, "%s %-5s %s", t.Format("2006-01-02T15:04:05.000"), level, msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		s := fmt.Sprint(logFieldValue(fields[i+1]))
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(&buf, " %v=%s", fields[i], s)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// stdLogWriter 把标准库 log 的一行输出转换为结构化日志。
+type stdLogWriter struct{}
+
+var regStdLogCaller = regexp.MustCompile(`^(\S+\.go:\d+): `)
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	var caller string
+	if match := regStdLogCaller.FindStringSubmatch(msg); match != nil {
+		caller = match[1]
+		msg = msg[len(match[0]):]
+	}
+	level := levelInfo
+	switch {
+	case strings.HasPrefix(msg, "WARN:"):
+		level = levelWarn
+		msg = strings.TrimSpace(strings.TrimPrefix(msg, "WARN:"))
+	case strings.HasPrefix(msg, "ERROR:"):
+		level = levelError
+		msg = strings.TrimSpace(strings.TrimPrefix(msg, "ERROR:"))
+	}
+
+	logConfig.mu.Lock()
+	defer logConfig.mu.Unlock()
+	if level < logConfig.level {
+		return len(p), nil
+	}
+	var fields []interface{}
+	if caller != "" {
+		fields = append(fields, "caller", caller)
+	}
+	logConfig.w.Write(formatLogEntry(time.Now(), level, msg, fields, logConfig.json))
+	return len(p), nil
+}
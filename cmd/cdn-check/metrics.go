@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 以 Prometheus 文本格式导出检测结果，标签和 InfluxDB 第 2 版的 tag 一致（除了 run_id）：
+// 镜像和 CDN 节点用 mirror_id、url、protocol、country、state 等，
+// CDN 节点另有 node_ip_addr，上游用 url。run_id 只在 run_info 中。
+
+const metricsPrefix = "mirror_status_"
+
+type metricFamily struct {
+	name    string
+	help    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels [][2]string
+	value  float64
+}
+
+func (mf *metricFamily) add(value float64, labels ...string) {
+	var sample metricSample
+	for i := 0; i+1 < len(labels); i += 2 {
+		sample.labels = append(sample.labels, [2]string{labels[i], labels[i+1]})
+	}
+	sample.value = value
+	mf.samples = append(mf.samples, sample)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (mf *metricFamily) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n", metricsPrefix, mf.name, mf.help)
+	fmt.Fprintf(w, "# TYPE %s%s gauge\n", metricsPrefix, mf.name)
+	for _, sample := range mf.samples {
+		fmt.Fprint(w, metricsPrefix, mf.name)
+		if len(sample.labels) > 0 {
+			var labels []string
+			for _, label := range sample.labels {
+				labels = append(labels, label[0]+`="`+
+					labelValueReplacer.Replace(label[1])+`"`)
+			}
+			fmt.Fprintf(w, "{%s}", strings.Join(labels, ","))
+		}
+		fmt.Fprintf(w, " %g\n", sample.value)
+	}
+}
+
+func getRunMetrics(run *checkRun) []*metricFamily {
+	mirrorProgress := &metricFamily{name: "mirror_progress",
+		help: "Ratio of sampled files in sync with upstream."}
+	mirrorLatency := &metricFamily{name: "mirror_latency_seconds",
+		help: "Average time to check a file, including retries."}
+	mirrorFiles := &metricFamily{name: "mirror_files",
+		help: "Number of files checked."}
+	mirrorErrors := &metricFamily{name: "mirror_errors",
+		help: "Number of files failed to check by error class."}
+	cdnProgress := &metricFamily{name: "cdn_node_progress",
+		help: "Ratio of sampled files in sync with upstream on a CDN node."}
+	cdnLatency := &metricFamily{name: "cdn_node_latency_seconds",
+		help: "Average time to check a file on a CDN node, including retries."}
+	upstreamCoverage := &metricFamily{name: "upstream_coverage",
+		help: "Ratio of sampled files fetched from upstream successfully."}
+	runDuration := &metricFamily{name: "run_duration_seconds",
+		help: "Duration of the last run."}
+	runTimestamp := &metricFamily{name: "run_timestamp_seconds",
+		help: "Unix time the last run finished."}
+	runInfo := &metricFamily{name: "run_info",
+		help: "Id of the last run, always 1."}
+
+	mirrorsAdded := make(map[string]struct{})
+	for _, tr := range run.testResults {
+		if tr.urlPrefix == "" {
+			continue
+		}
+
+		if tr.upstream {
+			upstreamCoverage.add(tr.percent/100.0, "url", tr.urlPrefix)
+			continue
+		}
+
+		// run_id 每次检测都不同，作为标签会产生无限多的序列，只放在 run_info 中
+		tags := getMirrorTags(run, tr)
+		tags.RunId = ""
+
+		if tr.cdnNodeAddress != "" {
+			cdnProgress.add(tr.percent/100.0, tags.Pairs()...)
+			cdnLatency.add(tr.avgLatency().Seconds(), tags.Pairs()...)
+			// 和 InfluxDB 一样，CDN 只用第一个节点的结果作为镜像的结果
+			if _, ok := mirrorsAdded[tr.name]; ok {
+				continue
+			}
+			mirrorsAdded[tr.name] = struct{}{}
+			tags.NodeIpAddr = ""
+		}
+
+		labels := tags.Pairs()
+		mirrorProgress.add(tr.percent/100.0, labels...)
+		mirrorLatency.add(tr.avgLatency().Seconds(), labels...)
+		mirrorFiles.add(float64(len(tr.records)), labels...)
+		errorClasses := tr.errorClasses()
+		var classes []string
+		for class := range errorClasses {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			mirrorErrors.add(float64(errorClasses[class]), append(labels, "class", class)...)
+		}
+	}
+
+	runDuration.add(run.endTime.Sub(run.startTime).Seconds())
+	runTimestamp.add(float64(run.endTime.Unix()))
+	runInfo.add(1, "run_id", run.id)
+
+	return []*metricFamily{
+		mirrorProgress, mirrorLatency, mirrorFiles, mirrorErrors,
+		cdnProgress, cdnLatency, upstreamCoverage, runDuration, runTimestamp, runInfo,
+	}
+}
+
+func writeRunMetrics(w io.Writer, run *checkRun) error {
+	bw := bufio.NewWriter(w)
+	for _, mf := range getRunMetrics(run) {
+		mf.writeTo(bw)
+	}
+	return bw.Flush()
+}
+
+// saveRunMetrics 写入 node_exporter textfile collector 读取的文件，
+// 先写临时文件再改名，避免被读到写了一半的文件。
+func saveRunMetrics(filename string, run *checkRun) error {
+	dir := filepath.Dir(filename)
+	f, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = writeRunMetrics(f, run)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 )
 
 type unpublishedMirrors struct {
@@ -21,6 +22,10 @@ type mirror struct {
 	UrlFtp   string                       `json:"urlFtp"`
 	Country  string                       `json:"country"`
 	Locale   map[string]map[string]string `json:"locale"`
+
+	// 镜像管理员的联系方式
+	AdminName  string `json:"adminName"`
+	AdminEmail string `json:"adminEmail"`
 }
 
 func (m *mirror) getUrlPrefix() (result string) {
@@ -33,8 +38,28 @@ func (m *mirror) getUrlPrefix() (result string) {
 	return
 }
 
+// joinUrl 返回镜像上文件的 url，urlPrefix 结尾没有 "/" 时补上。
+func joinUrl(urlPrefix, filePath string) string {
+	if !strings.HasSuffix(urlPrefix, "/") {
+		urlPrefix += "/"
+	}
+	return urlPrefix + filePath
+}
+
 type mirrors []*mirror
 
+// withoutContacts 返回去掉管理员联系方式的副本，保存检测结果和发给 agent 时使用。
+func (v mirrors) withoutContacts() mirrors {
+	result := make(mirrors, 0, len(v))
+	for _, m := range v {
+		m1 := *m
+		m1.AdminName = ""
+		m1.AdminEmail = ""
+		result = append(result, &m1)
+	}
+	return result
+}
+
 // implement sort.Interface interface
 
 func (v mirrors) Len() int {
@@ -49,6 +74,15 @@ func (v mirrors) Swap(i, j int) {
 	v[i], v[j] = v[j], v[i]
 }
 
+func (v mirrors) get(id string) *mirror {
+	for _, m := range v {
+		if m.Id == id {
+			return m
+		}
+	}
+	return nil
+}
+
 func getUnpublishedMirrors(url string) (mirrors, error) {
 	log.Println("mirrors api url:", url)
 
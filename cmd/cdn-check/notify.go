@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// notifier 发送告警通知。
+type notifier interface {
+	name() string
+	notify(alerts []*alert) error
+}
+
+// parseNotifiers 解析逗号分隔的通知目标：
+//
+//	webhook+URL    POST JSON {"alerts": [...]}
+//	slack+URL      Slack incoming webhook
+//	dingtalk+URL   钉钉机器人
+//	smtp://user@host:port?from=ADDR&to=ADDR&to=ADDR  邮件，密码从环境变量 SMTP_PASSWORD 读取
+func parseNotifiers(specs string) ([]notifier, error) {
+	var result []notifier
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		n, err := parseNotifier(spec)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+func parseNotifier(spec string) (notifier, error) {
+	switch {
+	case strings.HasPrefix(spec, "webhook+"):
+		return newWebhookNotifier(strings.TrimPrefix(spec, "webhook+"), webhookFormatJSON), nil
+	case strings.HasPrefix(spec, "slack+"):
+		return newWebhookNotifier(strings.TrimPrefix(spec, "slack+"), webhookFormatSlack), nil
+	case strings.HasPrefix(spec, "dingtalk+"):
+		return newWebhookNotifier(strings.TrimPrefix(spec, "dingtalk+"), webhookFormatDingTalk), nil
+	case strings.HasPrefix(spec, "smtp://"):
+		n, err := newSmtpNotifier(spec)
+		if err != nil {
+			return nil, err
+		}
+		if len(n.to) == 0 {
+			return nil, errors.New("smtp notifier requires to: " + spec)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("invalid notifier %q", spec)
+}
+
+func formatAlertLine(a *alert) string {
+	return fmt.Sprintf("[%s] %s %s: %s", strings.ToUpper(a.Status), a.Rule, a.Target, a.Message)
+}
+
+func formatAlerts(alerts []*alert) string {
+	var buf bytes.Buffer
+	for _, a := range alerts {
+		buf.WriteString(formatAlertLine(a))
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+func getAlertsSubject(alerts []*alert) string {
+	var numFiring, numResolved int
+	for _, a := range alerts {
+		if a.Status == alertStatusFiring {
+			numFiring++
+		} else {
+			numResolved++
+		}
+	}
+	return fmt.Sprintf("mirror status: %d firing, %d resolved", numFiring, numResolved)
+}
+
+const (
+	webhookFormatJSON     = "webhook"
+	webhookFormatSlack    = "slack"
+	webhookFormatDingTalk = "dingtalk"
+)
+
+type webhookNotifier struct {
+	url    string
+	format string
+	client *http.Client
+}
+
+func newWebhookNotifier(url, format string) *webhookNotifier {
+	return &webhookNotifier{
+		url:    url,
+		format: format,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (n *webhookNotifier) name() string {
+	return n.format
+}
+
+func (n *webhookNotifier) notify(alerts []*alert) error {
+	var body interface{}
+	text := getAlertsSubject(alerts) + "\n" + formatAlerts(alerts)
+	switch n.format {
+	case webhookFormatSlack:
+		body = map[string]string{"text": text}
+	case webhookFormatDingTalk:
+		body = map[string]interface{}{
+			"msgtype": "text",
+			"text":    map[string]string{"content": text},
+		}
+	default:
+		body = map[string]interface{}{"alerts": alerts}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: status %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+type smtpNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+func newSmtpNotifier(spec string) (*smtpNotifier, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	n := &smtpNotifier{addr: u.Host}
+	if u.Port() == "" {
+		n.addr = net.JoinHostPort(u.Hostname(), "25")
+	}
+	if u.User != nil {
+		password, ok := u.User.Password()
+		if !ok {
+			password = os.Getenv("SMTP_PASSWORD")
+		}
+		n.auth = smtp.PlainAuth("", u.User.Username(), password, u.Hostname())
+	}
+	query := u.Query()
+	n.from = query.Get("from")
+	n.to = query["to"]
+	if n.from == "" {
+		return nil, errors.New("smtp notifier requires from: " + spec)
+	}
+	return n, nil
+}
+
+func (n *smtpNotifier) name() string {
+	return "smtp " + n.addr
+}
+
+func (n *smtpNotifier) notify(alerts []*alert) error {
+	return n.sendMail(n.to, getAlertsSubject(alerts), formatAlerts(alerts))
+}
+
+func (n *smtpNotifier) sendMail(to []string, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return smtp.SendMail(n.addr, n.auth, n.from, to, msg.Bytes())
+}
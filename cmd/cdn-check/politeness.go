@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// 对镜像服务器的礼貌：同一个主机（多个镜像条目可能在同一个主机上）同时进行的文件检测
+// 不超过 -host-concurrency，每秒开始的文件检测不超过 -host-rate，这两个限制由调度器执行；
+// 每个镜像（CDN 的每个节点）在一次检测中下载的字节数不超过 -mirror-byte-budget，
+// 超出后剩下的文件记为错误而不再请求。上游不受限制。
+
+const defaultUserAgent = "mirror_status-cdn-check/1.0 (+https://ci.deepin.io/job/mirror_status)"
+
+var errByteBudgetExceeded = errors.New("byte budget of the mirror exceeded")
+
+// politeHost 返回需要限制的主机名，上游和没有限制时返回空字符串。
+func politeHost(u *url.URL) string {
+	if optHostConcurrency <= 0 && optHostRate <= 0 {
+		return ""
+	}
+	host := u.Hostname()
+	if upstreamUrl, err := url.Parse(baseUrl); err == nil && upstreamUrl.Hostname() == host {
+		return ""
+	}
+	return host
+}
+
+// politeHostOf 和 politeHost 一样，参数是 url 字符串。
+func politeHostOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return politeHost(u)
+}
+
+// hostInterval 返回同一个主机开始两个文件检测的最小间隔，没有限制时返回 0。
+func hostInterval() time.Duration {
+	if optHostRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / optHostRate)
+}
+
+// byteBudget 是一个镜像（CDN 的一个节点）在一次检测中还可以下载的字节数。
+type byteBudget struct {
+	mu        sync.Mutex
+	remaining int64
+}
+
+func newByteBudget(n int64) *byteBudget {
+	if n <= 0 {
+		return nil
+	}
+	return &byteBudget{remaining: n}
+}
+
+func (b *byteBudget) exhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.remaining <= 0
+}
+
+func (b *byteBudget) consume(n int) {
+	b.mu.Lock()
+	b.remaining -= int64(n)
+	b.mu.Unlock()
+}
+
+// budgetTransport 统计响应的字节数，预算用完后不再发出请求。
+type budgetTransport struct {
+	base   http.RoundTripper
+	budget *byteBudget
+}
+
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.budget.exhausted() {
+		return nil, errByteBudgetExceeded
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &budgetBody{ReadCloser: resp.Body, budget: t.budget}
+	return resp, nil
+}
+
+type budgetBody struct {
+	io.ReadCloser
+	budget *byteBudget
+}
+
+func (b *budgetBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.budget.consume(n)
+	return n, err
+}
+
+// withByteBudget 返回共用 client 的连接、但受 budget 限制的 client，budget 为 nil 时返回 client。
+func withByteBudget(client *http.Client, budget *byteBudget) *http.Client {
+	if budget == nil {
+		return client
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c := *client
+	c.Transport = &budgetTransport{base: base, budget: budget}
+	return &c
+}
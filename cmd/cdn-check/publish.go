@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 根据检测结果生成给客户端使用的文件：
+//
+//	mirrorlist.txt  apt 的 mirror+file:// 镜像列表，只包含进度 100% 的已发布镜像
+//	release.meta4   Metalink 4 (RFC 5854)，列出 -metalink-files 匹配的文件和与上游一致的镜像
+//
+// 这样下载工具和安装器只会用到健康的镜像。
+
+const metalinkNS = "urn:ietf:params:xml:ns:metalink"
+
+type metalink struct {
+	XMLName   xml.Name        `xml:"metalink"`
+	NS        string          `xml:"xmlns,attr"`
+	Generator string          `xml:"generator"`
+	Published string          `xml:"published"`
+	Files     []*metalinkFile `xml:"file"`
+}
+
+type metalinkFile struct {
+	Name string         `xml:"name,attr"`
+	Size int            `xml:"size"`
+	Hash *metalinkHash  `xml:"hash,omitempty"`
+	Urls []*metalinkUrl `xml:"url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkUrl struct {
+	Location string `xml:"location,attr,omitempty"`
+	Priority int    `xml:"priority,attr"`
+	Url      string `xml:",chardata"`
+}
+
+// publishMirror 是镜像在检测中的结果，CDN 有多个节点时取最差的结果。
+type publishMirror struct {
+	mirror    *mirror
+	percent   float64
+	latency   time.Duration
+	files     map[string]bool
+	urlPrefix string
+}
+
+func getPublishMirrors(run *checkRun) []*publishMirror {
+	byId := make(map[string]*publishMirror)
+	var result []*publishMirror
+	for _, tr := range run.testResults {
+		if tr.upstream || tr.urlPrefix == "" {
+			continue
+		}
+		m := run.mirrors.get(tr.name)
+		if m == nil || m.Weight < 0 {
+			continue
+		}
+		pm := byId[tr.name]
+		if pm == nil {
+			pm = &publishMirror{
+				mirror:    m,
+				percent:   tr.percent,
+				files:     make(map[string]bool),
+				urlPrefix: strings.TrimSuffix(tr.urlPrefix, "/") + "/",
+			}
+			byId[tr.name] = pm
+			result = append(result, pm)
+		}
+		if tr.percent < pm.percent {
+			pm.percent = tr.percent
+		}
+		if latency := tr.avgLatency(); latency > pm.latency {
+			pm.latency = latency
+		}
+		for _, record := range tr.records {
+			equal := record.equal && record.err == nil
+			if old, ok := pm.files[record.standard.FilePath]; ok {
+				equal = equal && old
+			}
+			pm.files[record.standard.FilePath] = equal
+		}
+	}
+	// 延迟低的排在前面，延迟相同时权重高的排在前面
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].latency != result[j].latency {
+			return result[i].latency < result[j].latency
+		}
+		return result[i].mirror.Weight > result[j].mirror.Weight
+	})
+	return result
+}
+
+// hasFile 返回镜像上的文件是否与上游一致，没有被抽到的文件要求镜像进度为 100%。
+func (pm *publishMirror) hasFile(filePath string) bool {
+	if equal, ok := pm.files[filePath]; ok {
+		return equal
+	}
+	return pm.percent == 100
+}
+
+func writeMirrorList(w io.Writer, pms []*publishMirror, locale string) error {
+	bw := bufio.NewWriter(w)
+	priority := 1
+	for _, pm := range pms {
+		if pm.percent != 100 {
+			continue
+		}
+		m := pm.mirror
+		// apt 不认识的元数据会报错，名称和国家写在注释中
+		fmt.Fprintf(bw, "# %s (%s, %s)\n", m.getLocalizedName(locale), m.Id,
+			strings.ToUpper(m.Country))
+		fmt.Fprintf(bw, "%s\tpriority:%d\n", pm.urlPrefix, priority)
+		priority++
+	}
+	return bw.Flush()
+}
+
+func newMetalink(run *checkRun, pms []*publishMirror, patterns []string) *metalink {
+	ml := &metalink{
+		NS:        metalinkNS,
+		Generator: "cdn-check",
+		Published: run.endTime.UTC().Format(time.RFC3339),
+	}
+	if run.snapshot == nil {
+		return ml
+	}
+	for _, vi := range run.snapshot.ValidateInfoList {
+		if !matchAnyPattern(patterns, vi.FilePath) {
+			continue
+		}
+		f := &metalinkFile{
+			Name: vi.FilePath,
+			Size: vi.Size,
+		}
+		// 大文件只校验了开头和结尾，没有整个文件的 md5
+		if vi.Size <= checkPartSize && len(vi.MD5Sum) > 0 {
+			f.Hash = &metalinkHash{Type: "md5", Value: hex.EncodeToString(vi.MD5Sum)}
+		}
+		for _, pm := range pms {
+			if !pm.hasFile(vi.FilePath) {
+				continue
+			}
+			f.Urls = append(f.Urls, &metalinkUrl{
+				Location: strings.ToLower(pm.mirror.Country),
+				Priority: len(f.Urls) + 1,
+				Url:      joinUrl(pm.urlPrefix, vi.FilePath),
+			})
+		}
+		// 上游总是最后的选择
+		f.Urls = append(f.Urls, &metalinkUrl{
+			Priority: len(f.Urls) + 1,
+			Url:      joinUrl(baseUrl, vi.FilePath),
+		})
+		ml.Files = append(ml.Files, f)
+	}
+	return ml
+}
+
+func matchAnyPattern(patterns []string, filePath string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, filePath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFileAtomic(filename string, write func(w io.Writer) error) error {
+	dir := filepath.Dir(filename)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// publishRun 把检测结果生成的镜像列表和 Metalink 写入 dir。
+func publishRun(run *checkRun, dir string) error {
+	pms := getPublishMirrors(run)
+	err := writeFileAtomic(filepath.Join(dir, "mirrorlist.txt"), func(w io.Writer) error {
+		return writeMirrorList(w, pms, optPublishLocale)
+	})
+	if err != nil {
+		return err
+	}
+
+	var patterns []string
+	for _, pattern := range strings.Split(optMetalinkFiles, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	ml := newMetalink(run, pms, patterns)
+	return writeFileAtomic(filepath.Join(dir, "release.meta4"), func(w io.Writer) error {
+		_, err := io.WriteString(w, xml.Header)
+		if err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		err = enc.Encode(ml)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, "\n")
+		return err
+	})
+}
+
+func publishRunIfNeeded(run *checkRun) {
+	if optPublishDir == "" {
+		return
+	}
+	err := publishRun(run, optPublishDir)
+	if err != nil {
+		log.Println("WARN: publish:", err)
+	}
+}
+
+// publishMain 实现 publish 子命令，用保存的检测结果生成镜像列表和 Metalink。
+func publishMain(args []string) {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	var runPath, dir string
+	fs.StringVar(&runPath, "run", filepath.Join("result", "run.json"),
+		"JSON result of cdn-check, or a directory of results such as serve-data/runs")
+	fs.StringVar(&dir, "o", "publish", "output directory")
+	fs.Parse(args)
+
+	filename, _, err := getLatestRunFile(runPath)
+	if err != nil {
+		fatal(err)
+	}
+	run, err := loadCheckRun(filename, optSnapshotDir)
+	if err != nil {
+		fatal(err)
+	}
+	if run.snapshot == nil {
+		log.Println("WARN: snapshot of the run not found, the metalink will be empty")
+	}
+	err = publishRun(run, dir)
+	if err != nil {
+		fatal(err)
+	}
+}
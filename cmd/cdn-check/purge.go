@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cdnHost = "cdn.packages.deepin.com"
+
+type purgeCheckResult struct {
+	cdnNodeAddress string
+	converged      bool
+	duration       time.Duration
+	numRounds      int
+	pending        []string
+}
+
+type purgeCheckResultSlice []*purgeCheckResult
+
+func (v purgeCheckResultSlice) Len() int {
+	return len(v)
+}
+
+func (v purgeCheckResultSlice) Less(i, j int) bool {
+	return v[i].cdnNodeAddress < v[j].cdnNodeAddress
+}
+
+func (v purgeCheckResultSlice) Swap(i, j int) {
+	v[i], v[j] = v[j], v[i]
+}
+
+// purgeCheckMain 实现 purge-check 子命令，在刷新 CDN 缓存后，
+// 轮询每个 CDN 节点，直到所有文件都与上游一致或者超时。
+func purgeCheckMain(args []string) {
+	fs := flag.NewFlagSet("purge-check", flag.ExitOnError)
+	var changelist string
+	var interval time.Duration
+	var timeout time.Duration
+	fs.StringVar(&changelist, "changelist", "",
+		"check files added by this changelist, e.g. 1540000000.json")
+	fs.DurationVar(&interval, "interval", 30*time.Second, "poll interval")
+	fs.DurationVar(&timeout, "timeout", 30*time.Minute,
+		"give up on a cdn node after this duration")
+	fs.Parse(args)
+
+	files, err := getPurgeCheckFiles(changelist, fs.Args())
+	if err != nil {
+		fatal(err)
+	}
+	if len(files) == 0 {
+		fatal("no file to check, give paths or -changelist")
+	}
+
+	validateInfoList, upstreamErrs, err := getValidateInfoList(files)
+	if err != nil {
+		fatal(err)
+	}
+	for file, err := range upstreamErrs {
+		log.Printf("WARN: skip %s, failed to get it from upstream: %v\n", file, err)
+	}
+	if len(validateInfoList) == 0 {
+		fatal("failed to get all files from upstream, nothing to check")
+	}
+
+	err = prefetchCdnDns(cdnHost)
+	if err != nil {
+		log.Println("WARN:", err)
+	}
+	ips := getCdnDns(cdnHost)
+	if len(ips) == 0 {
+		fatal("no cdn node found")
+	}
+	log.Printf("purge-check files: %d, cdn nodes: %v\n", len(validateInfoList), ips)
+
+	var results purgeCheckResultSlice
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	t0 := time.Now()
+	for _, ip := range ips {
+		wg.Add(1)
+		go func(ip string) {
+			r := pollCdnNode(ip, validateInfoList, t0, interval, timeout)
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+			wg.Done()
+		}(ip)
+	}
+	wg.Wait()
+	sort.Sort(results)
+
+	err = savePurgeCheckResults(results)
+	if err != nil {
+		log.Println("WARN:", err)
+	}
+
+	var numTimeout int
+	for _, r := range results {
+		if r.converged {
+			fmt.Printf("%s converged after %v (%d rounds)\n",
+				r.cdnNodeAddress, r.duration, r.numRounds)
+		} else {
+			numTimeout++
+			fmt.Printf("%s timeout after %v, %d files not match\n",
+				r.cdnNodeAddress, r.duration, len(r.pending))
+		}
+	}
+	if len(upstreamErrs) > 0 {
+		fmt.Printf("%d files not checked, failed to get them from upstream\n", len(upstreamErrs))
+	}
+	// 有文件没有检查时也不能认为刷新成功
+	if numTimeout > 0 || len(upstreamErrs) > 0 {
+		os.Exit(1)
+	}
+}
+
+func getPurgeCheckFiles(changelist string, paths []string) ([]string, error) {
+	filesMap := make(map[string]struct{})
+	for _, p := range paths {
+		filesMap[strings.TrimPrefix(p, "/")] = struct{}{}
+	}
+
+	if changelist != "" {
+		if !strings.HasSuffix(changelist, ".json") {
+			changelist += ".json"
+		}
+		ci, err := getChangeInfo(changelist)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range ci.Added {
+			if ignoreFile(a.FilePath) {
+				continue
+			}
+			filesMap[a.FilePath] = struct{}{}
+		}
+	}
+
+	files := make([]string, 0, len(filesMap))
+	for file := range filesMap {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// pollCdnNode 每隔 interval 检测一次尚未一致的文件，
+// 返回的 duration 是从 t0 开始到全部一致所用的时间。
+func pollCdnNode(cdnNodeAddress string, validateInfoList []*FileValidateInfo,
+	t0 time.Time, interval, timeout time.Duration) *purgeCheckResult {
+	client := getHttpClient(1000)
+	pending := validateInfoList
+	r := &purgeCheckResult{
+		cdnNodeAddress: cdnNodeAddress,
+	}
+
+	for {
+		r.numRounds++
+		// 和检测一样经过调度器，逐个检测
+		var stillPending []*FileValidateInfo
+		queue := testScheduler.newQueue("purge "+cdnNodeAddress, politeHost(&url.URL{Host: cdnNodeAddress}), true, 1)
+		for _, vi := range pending {
+			vi := vi
+			queue.add(func() {
+				vi1, err := checkFileCdn(fileInfo{
+					FilePath: vi.FilePath,
+				}, cdnNodeAddress, client, defaultLogger.with("mirror_id", "default", "node", cdnNodeAddress))
+				if err != nil {
+					log.Println("WARN:", err)
+					stillPending = append(stillPending, vi)
+					return
+				}
+				if !vi.equal(vi1) {
+					stillPending = append(stillPending, vi)
+				}
+			})
+		}
+		queue.wait()
+		pending = stillPending
+		r.duration = time.Since(t0)
+		log.Printf("purge-check %s round %d, %d/%d files not match\n",
+			cdnNodeAddress, r.numRounds, len(pending), len(validateInfoList))
+
+		if len(pending) == 0 {
+			r.converged = true
+			return r
+		}
+		if r.duration+interval > timeout {
+			break
+		}
+		time.Sleep(interval)
+	}
+
+	for _, vi := range pending {
+		r.pending = append(r.pending, vi.FilePath)
+	}
+	r.duration = time.Since(t0)
+	return r
+}
+
+func savePurgeCheckResults(results []*purgeCheckResult) error {
+	err := makeResultDir()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join("result", "purge-check.txt"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bw := bufio.NewWriter(f)
+
+	for _, r := range results {
+		fmt.Fprintln(bw, "cdn node address:", r.cdnNodeAddress)
+		fmt.Fprintln(bw, "converged:", r.converged)
+		fmt.Fprintln(bw, "duration:", r.duration)
+		fmt.Fprintln(bw, "rounds:", r.numRounds)
+		for _, file := range r.pending {
+			fmt.Fprintln(bw, "pending:", file)
+		}
+		fmt.Fprintln(bw)
+	}
+
+	return bw.Flush()
+}
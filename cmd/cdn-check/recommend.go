@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"mirror_status/sink"
+)
+
+// recommend 子命令根据历史数据库中最近的检测结果，给每个镜像推荐是否发布和权重，
+// 生成可以审阅的计划文件，确认后用 -apply 写回 CMS。权重为负数的镜像不对用户发布。
+
+type recommendPolicy struct {
+	days    int
+	minRuns int
+
+	// 满足任一条件时隐藏已发布的镜像
+	hideProgress float64
+	hideLag      time.Duration
+	hideErrRate  float64
+	hideLatency  time.Duration
+
+	// 满足所有条件时发布隐藏的镜像，比隐藏的条件严格，避免反复发布和隐藏
+	publishProgress float64
+	publishLag      time.Duration
+	publishErrRate  float64
+	publishLatency  time.Duration
+}
+
+// mirrorStats 是镜像在最近一段时间的检测结果统计。
+type mirrorStats struct {
+	numRuns     int
+	avgProgress float64
+	lastSync    time.Time // 最后一次 100% 同步的时间
+	lag         time.Duration
+	errRate     float64
+	avgLatency  time.Duration
+}
+
+type recommendation struct {
+	MirrorId  string    `json:"mirrorId"`
+	OldWeight int       `json:"oldWeight"`
+	NewWeight int       `json:"newWeight"`
+	OldState  string    `json:"oldState"`
+	NewState  string    `json:"newState"`
+	Reasons   []string  `json:"reasons"`
+	NumRuns   int       `json:"numRuns"`
+	Progress  float64   `json:"progress"`
+	LastSync  time.Time `json:"lastSync,omitempty"`
+	ErrRate   float64   `json:"errRate"`
+	Latency   float64   `json:"latency"` // 秒
+}
+
+type recommendPlan struct {
+	CreatedAt time.Time         `json:"createdAt"`
+	Days      int               `json:"days"`
+	Changes   []*recommendation `json:"changes"`
+}
+
+// getMirrorStats 从历史数据库中统计每个镜像最近 days 天的结果，不包括 CDN 节点。
+func getMirrorStats(db *bolt.DB, days int, now time.Time) (map[string]*mirrorStats, error) {
+	result := make(map[string]*mirrorStats)
+	minKey := []byte(sink.RunId(now.AddDate(0, 0, -days)))
+	err := db.View(func(tx *bolt.Tx) error {
+		pb := tx.Bucket(bucketMirrors)
+		if pb == nil {
+			return nil
+		}
+		return pb.ForEach(func(name, _ []byte) error {
+			stats := &mirrorStats{}
+			var sumProgress float64
+			var sumLatency time.Duration
+			var numErrs, numFiles int
+			var firstTime time.Time
+			c := pb.Bucket(name).Cursor()
+			for k, v := c.Seek(minKey); k != nil; k, v = c.Next() {
+				var r historyMirrorResult
+				err := json.Unmarshal(v, &r)
+				if err != nil {
+					return err
+				}
+				if r.CdnNodeAddress != "" {
+					continue
+				}
+				if firstTime.IsZero() {
+					firstTime = r.Time
+				}
+				stats.numRuns++
+				sumProgress += r.Percent
+				sumLatency += r.Latency
+				numErrs += r.NumErrs
+				numFiles += r.NumFiles
+				if r.Percent == 100 {
+					stats.lastSync = r.Time
+				}
+			}
+			if stats.numRuns == 0 {
+				return nil
+			}
+			stats.avgProgress = sumProgress / float64(stats.numRuns)
+			stats.avgLatency = sumLatency / time.Duration(stats.numRuns)
+			if numFiles > 0 {
+				stats.errRate = float64(numErrs) / float64(numFiles)
+			}
+			// 时间范围内没有同步过时，至少落后了整个时间范围
+			if stats.lastSync.IsZero() {
+				stats.lag = now.Sub(firstTime)
+			} else {
+				stats.lag = now.Sub(stats.lastSync)
+			}
+			result[string(name)] = stats
+			return nil
+		})
+	})
+	return result, err
+}
+
+func (p *recommendPolicy) hideReasons(s *mirrorStats) []string {
+	var reasons []string
+	if s.avgProgress < p.hideProgress {
+		reasons = append(reasons, fmt.Sprintf("progress %.2f%% < %.2f%%", s.avgProgress, p.hideProgress))
+	}
+	if s.lag > p.hideLag {
+		reasons = append(reasons, fmt.Sprintf("lag %v > %v", s.lag.Round(time.Hour), p.hideLag))
+	}
+	if s.errRate > p.hideErrRate {
+		reasons = append(reasons, fmt.Sprintf("error rate %.3f > %.3f", s.errRate, p.hideErrRate))
+	}
+	if p.hideLatency > 0 && s.avgLatency > p.hideLatency {
+		reasons = append(reasons, fmt.Sprintf("latency %v > %v",
+			s.avgLatency.Round(time.Millisecond), p.hideLatency))
+	}
+	return reasons
+}
+
+func (p *recommendPolicy) canPublish(s *mirrorStats) bool {
+	return s.avgProgress >= p.publishProgress &&
+		s.lag <= p.publishLag &&
+		s.errRate <= p.publishErrRate &&
+		(p.publishLatency <= 0 || s.avgLatency <= p.publishLatency)
+}
+
+// recommend 返回需要修改权重的镜像。隐藏镜像时把权重取反，权重为 0 的镜像隐藏时改为 -1；
+// 发布时恢复为 hidden 中记录的隐藏前的权重，没有记录时把权重取反。
+func (p *recommendPolicy) recommend(ms mirrors, stats map[string]*mirrorStats,
+	hidden map[string]hiddenWeight) []*recommendation {
+	var changes []*recommendation
+	for _, m := range ms {
+		if m.Id == "default" {
+			// CDN 不由镜像检测结果决定是否发布
+			continue
+		}
+		s := stats[m.Id]
+		if s == nil || s.numRuns < p.minRuns {
+			continue
+		}
+		r := &recommendation{
+			MirrorId:  m.Id,
+			OldWeight: m.Weight,
+			OldState:  sink.MirrorState(m.Weight),
+			NumRuns:   s.numRuns,
+			Progress:  s.avgProgress,
+			LastSync:  s.lastSync,
+			ErrRate:   s.errRate,
+			Latency:   s.avgLatency.Seconds(),
+		}
+		if r.OldState == "published" {
+			r.Reasons = p.hideReasons(s)
+			if len(r.Reasons) == 0 {
+				continue
+			}
+			r.NewWeight = -m.Weight
+			if r.NewWeight == 0 {
+				r.NewWeight = -1
+			}
+		} else {
+			if !p.canPublish(s) {
+				continue
+			}
+			r.Reasons = []string{fmt.Sprintf("healthy for %d runs, progress %.2f%%, lag %v",
+				s.numRuns, s.avgProgress, s.lag.Round(time.Hour))}
+			r.NewWeight = -m.Weight
+			if hw, ok := hidden[m.Id]; ok && hw.hidden == m.Weight {
+				r.NewWeight = hw.original
+			}
+		}
+		r.NewState = sink.MirrorState(r.NewWeight)
+		changes = append(changes, r)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].MirrorId < changes[j].MirrorId
+	})
+	return changes
+}
+
+func (plan *recommendPlan) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MIRROR\tSTATE\tWEIGHT\tRUNS\tPROGRESS\tERR RATE\tREASONS")
+	for _, r := range plan.Changes {
+		fmt.Fprintf(w, "%s\t%s -> %s\t%d -> %d\t%d\t%.2f%%\t%.3f\t%s\n", r.MirrorId,
+			r.OldState, r.NewState, r.OldWeight, r.NewWeight, r.NumRuns, r.Progress,
+			r.ErrRate, strings.Join(r.Reasons, "; "))
+	}
+	w.Flush()
+	if len(plan.Changes) == 0 {
+		fmt.Println("no change")
+	}
+}
+
+func (plan *recommendPlan) save(filename string) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+func loadRecommendPlan(filename string) (*recommendPlan, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var plan recommendPlan
+	err = json.Unmarshal(data, &plan)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return &plan, nil
+}
+
+type cmsAuditEntry struct {
+	Time      time.Time `json:"time"`
+	MirrorId  string    `json:"mirrorId"`
+	OldWeight int       `json:"oldWeight"`
+	NewWeight int       `json:"newWeight"`
+	Reasons   []string  `json:"reasons"`
+	DryRun    bool      `json:"dryRun"`
+	Status    string    `json:"status"`
+	Err       string    `json:"err,omitempty"`
+}
+
+// hiddenWeight 是 recommend 隐藏镜像前后的权重。
+type hiddenWeight struct {
+	original int
+	hidden   int
+}
+
+// loadHiddenWeights 从审计日志中找出被 recommend 隐藏、之后没有再修改过的镜像。
+// 审计日志不存在时返回空的结果。
+func loadHiddenWeights(filename string) (map[string]hiddenWeight, error) {
+	result := make(map[string]hiddenWeight)
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		var entry cmsAuditEntry
+		err = dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if entry.Status != "applied" {
+			continue
+		}
+		if entry.NewWeight < 0 && entry.OldWeight >= 0 {
+			result[entry.MirrorId] = hiddenWeight{original: entry.OldWeight, hidden: entry.NewWeight}
+		} else {
+			delete(result, entry.MirrorId)
+		}
+	}
+	return result, nil
+}
+
+func appendAuditLog(filename string, entry *cmsAuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// setMirrorWeight 用 PATCH <cms url>/<mirror id> 修改镜像的权重，
+// token 从环境变量 CMS_TOKEN 读取。
+func setMirrorWeight(cmsUrl, mirrorId string, weight int) error {
+	data, err := json.Marshal(map[string]int{"weight": weight})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPatch,
+		strings.TrimSuffix(cmsUrl, "/")+"/"+mirrorId, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := os.Getenv("CMS_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("set weight of %s: status %s: %s", mirrorId, resp.Status,
+			bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// applyRecommendPlan 把计划写回 CMS。CMS 中的权重已经不是计划生成时的权重时，
+// 说明有人手动修改过，跳过这个镜像。
+func applyRecommendPlan(plan *recommendPlan, cmsUrl, auditLog string, dryRun bool) error {
+	ms, err := getUnpublishedMirrors(cmsUrl)
+	if err != nil {
+		return err
+	}
+	var numErrs int
+	for _, r := range plan.Changes {
+		entry := &cmsAuditEntry{
+			Time:      time.Now(),
+			MirrorId:  r.MirrorId,
+			OldWeight: r.OldWeight,
+			NewWeight: r.NewWeight,
+			Reasons:   r.Reasons,
+			DryRun:    dryRun,
+		}
+		m := ms.get(r.MirrorId)
+		switch {
+		case m == nil:
+			entry.Status = "skipped"
+			entry.Err = "mirror not found in cms"
+		case m.Weight != r.OldWeight:
+			entry.Status = "skipped"
+			entry.Err = fmt.Sprintf("weight changed to %d after the plan was made", m.Weight)
+		case dryRun:
+			entry.Status = "dry-run"
+		default:
+			err = setMirrorWeight(cmsUrl, r.MirrorId, r.NewWeight)
+			if err != nil {
+				numErrs++
+				entry.Status = "failed"
+				entry.Err = err.Error()
+			} else {
+				entry.Status = "applied"
+			}
+		}
+		log.Printf("%s %s: weight %d -> %d %s\n", entry.Status, r.MirrorId,
+			r.OldWeight, r.NewWeight, entry.Err)
+		err = appendAuditLog(auditLog, entry)
+		if err != nil {
+			return err
+		}
+	}
+	if numErrs > 0 {
+		return fmt.Errorf("failed to apply %d changes", numErrs)
+	}
+	return nil
+}
+
+// recommendMain 实现 recommend 子命令。
+func recommendMain(args []string) {
+	fs := flag.NewFlagSet("recommend", flag.ExitOnError)
+	var p recommendPolicy
+	var output, apply, cmsUrl, auditLog string
+	var dryRun bool
+	fs.IntVar(&p.days, "days", 7, "use runs in the last days")
+	fs.IntVar(&p.minRuns, "min-runs", 3, "do not recommend for mirrors with fewer runs")
+	fs.Float64Var(&p.hideProgress, "hide-progress", 80, "hide mirrors with average progress below this")
+	fs.DurationVar(&p.hideLag, "hide-lag", 72*time.Hour, "hide mirrors not 100% in sync for this long")
+	fs.Float64Var(&p.hideErrRate, "hide-err-rate", 0.2, "hide mirrors with error rate above this")
+	fs.DurationVar(&p.hideLatency, "hide-latency", 0, "hide mirrors with average latency above this, 0 to ignore")
+	fs.Float64Var(&p.publishProgress, "publish-progress", 98, "publish mirrors with average progress of at least this")
+	fs.DurationVar(&p.publishLag, "publish-lag", 24*time.Hour, "publish mirrors 100% in sync within this")
+	fs.Float64Var(&p.publishErrRate, "publish-err-rate", 0.02, "publish mirrors with error rate of at most this")
+	fs.DurationVar(&p.publishLatency, "publish-latency", 0, "publish mirrors with average latency of at most this, 0 to ignore")
+	fs.StringVar(&output, "o", "result/recommend-plan.json", "file to save the plan")
+	fs.StringVar(&apply, "apply", "", "write the changes in this reviewed plan file back to the cms")
+	fs.BoolVar(&dryRun, "dry-run", false, "with -apply, only check and log the changes")
+	fs.StringVar(&cmsUrl, "cms-url", mirrorsUrl, "mirrors api of the cms")
+	fs.StringVar(&auditLog, "audit-log", "cms-audit.log", "file to append applied changes to")
+	fs.Parse(args)
+
+	if apply != "" {
+		plan, err := loadRecommendPlan(apply)
+		if err != nil {
+			fatal(err)
+		}
+		plan.print()
+		err = applyRecommendPlan(plan, cmsUrl, auditLog, dryRun)
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	db, err := openHistoryDB(optHistoryDB, true)
+	if err != nil {
+		fatal(err)
+	}
+	now := time.Now()
+	stats, err := getMirrorStats(db, p.days, now)
+	db.Close()
+	if err != nil {
+		fatal(err)
+	}
+	ms, err := getUnpublishedMirrors(cmsUrl)
+	if err != nil {
+		fatal(err)
+	}
+
+	hidden, err := loadHiddenWeights(auditLog)
+	if err != nil {
+		fatal(err)
+	}
+
+	plan := &recommendPlan{
+		CreatedAt: now,
+		Days:      p.days,
+		Changes:   p.recommend(ms, stats, hidden),
+	}
+	plan.print()
+	err = plan.save(output)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("\nplan saved to %s, review it and run: cdn-check recommend -apply %s\n", output, output)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redirector 实现 redirect 子命令，把 apt 的请求 302 重定向到客户端所在国家的、
+// 确认已经同步了被请求文件的镜像，没有合适的镜像时重定向到 CDN 或者上游。
+//
+// 一个镜像可以提供文件的条件：
+//   - 文件在最近一次检测中被抽到，检测结果一致；
+//   - 文件没有被抽到，不是检测之后的 changelist 新增的文件，镜像进度达到 -min-progress，
+//     pool 以外的文件（例如 dists 中的索引）要求镜像进度为 100%。
+type redirector struct {
+	runPath     string
+	minProgress float64
+	trustProxy  bool
+	geo         *geoIPDB
+	prefs       map[string][]string // 国家代码 -> 优先使用的镜像 id，* 用于所有国家
+
+	mu       sync.RWMutex
+	runFile  string
+	runMtime time.Time
+	run      *checkRun
+	mirrors  map[string]*redirectMirror
+	newFiles map[string]struct{} // 检测之后的 changelist 新增的文件
+	seenCl   map[string]struct{} // 已经处理过的 changelist
+}
+
+type redirectMirror struct {
+	id        string
+	urlPrefix string
+	country   string
+	weight    int
+	progress  float64
+	files     map[string]bool // 抽到的文件 -> 是否一致，CDN 所有节点都一致才算一致
+}
+
+func (m *redirectMirror) hasFile(filePath string, minProgress float64) bool {
+	if equal, ok := m.files[filePath]; ok {
+		return equal
+	}
+	if !strings.HasPrefix(filePath, "pool/") {
+		return m.progress == 100
+	}
+	return m.progress >= minProgress
+}
+
+func (m *redirectMirror) url(filePath string) string {
+	return joinUrl(m.urlPrefix, filePath)
+}
+
+func newRedirectMirrors(run *checkRun) map[string]*redirectMirror {
+	result := make(map[string]*redirectMirror)
+	for _, tr := range run.testResults {
+		if tr.upstream || tr.urlPrefix == "" {
+			continue
+		}
+		rm := result[tr.name]
+		if rm == nil {
+			rm = &redirectMirror{
+				id:        tr.name,
+				urlPrefix: tr.urlPrefix,
+				progress:  tr.percent,
+				files:     make(map[string]bool),
+			}
+			if m := run.mirrors.get(tr.name); m != nil {
+				rm.country = strings.ToUpper(m.Country)
+				rm.weight = m.Weight
+			}
+			result[tr.name] = rm
+		}
+		// CDN 的进度取所有节点中最低的
+		if tr.percent < rm.progress {
+			rm.progress = tr.percent
+		}
+		for _, record := range tr.records {
+			equal := record.equal && record.err == nil
+			if old, ok := rm.files[record.standard.FilePath]; ok {
+				equal = equal && old
+			}
+			rm.files[record.standard.FilePath] = equal
+		}
+	}
+	return result
+}
+
+// getLatestRunFile 返回 path 本身，path 是目录时返回其中最新的 JSON 结果，例如 serve 的 runs 目录。
+func getLatestRunFile(path string) (string, time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !fi.IsDir() {
+		return path, fi.ModTime(), nil
+	}
+	fileInfos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var latest os.FileInfo
+	for _, fi := range fileInfos {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		if latest == nil || fi.ModTime().After(latest.ModTime()) {
+			latest = fi
+		}
+	}
+	if latest == nil {
+		return "", time.Time{}, os.ErrNotExist
+	}
+	return filepath.Join(path, latest.Name()), latest.ModTime(), nil
+}
+
+// reload 在检测结果更新时重新加载。
+func (rd *redirector) reload() error {
+	filename, mtime, err := getLatestRunFile(rd.runPath)
+	if err != nil {
+		return err
+	}
+	rd.mu.RLock()
+	unchanged := filename == rd.runFile && mtime.Equal(rd.runMtime)
+	rd.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	run, err := loadCheckRun(filename, optSnapshotDir)
+	if err != nil {
+		return err
+	}
+	mirrors := newRedirectMirrors(run)
+	log.Printf("redirect: loaded run %s from %s, %d mirrors\n", run.id, filename, len(mirrors))
+
+	rd.mu.Lock()
+	rd.runFile = filename
+	rd.runMtime = mtime
+	rd.run = run
+	rd.mirrors = mirrors
+	rd.newFiles = make(map[string]struct{})
+	rd.seenCl = make(map[string]struct{})
+	rd.mu.Unlock()
+	return nil
+}
+
+// updateNewFiles 记录在检测开始之后发布的 changelist 新增的文件，镜像不可能已经检测过这些文件。
+func (rd *redirector) updateNewFiles() error {
+	rd.mu.RLock()
+	since := rd.run.startTime
+	if rd.run.snapshot != nil {
+		since = rd.run.snapshot.CreatedAt
+	}
+	rd.mu.RUnlock()
+
+	changeList, err := getChangeList()
+	if err != nil {
+		return err
+	}
+	for _, name := range changeList {
+		ts, err := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil || !time.Unix(ts, 0).After(since) {
+			continue
+		}
+		rd.mu.RLock()
+		_, seen := rd.seenCl[name]
+		rd.mu.RUnlock()
+		if seen {
+			continue
+		}
+
+		ci, err := getChangeInfo(name)
+		if err != nil {
+			log.Println("WARN:", err)
+			continue
+		}
+		rd.mu.Lock()
+		for _, a := range ci.Added {
+			rd.newFiles[a.FilePath] = struct{}{}
+		}
+		rd.seenCl[name] = struct{}{}
+		rd.mu.Unlock()
+		log.Printf("redirect: changelist %s added %d files after the run\n", name, len(ci.Added))
+	}
+	return nil
+}
+
+func (rd *redirector) refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := rd.reload()
+		if err == nil {
+			err = rd.updateNewFiles()
+		}
+		if err != nil {
+			log.Println("WARN: redirect:", err)
+		}
+	}
+}
+
+func (rd *redirector) getClientIP(r *http.Request) net.IP {
+	if rd.trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return net.ParseIP(strings.TrimSpace(strings.Split(xff, ",")[0]))
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// pickWeighted 按权重随机选择一个镜像，分散同一个国家中各镜像的负载。
+func pickWeighted(candidates []*redirectMirror) *redirectMirror {
+	if len(candidates) == 0 {
+		return nil
+	}
+	total := 0
+	for _, m := range candidates {
+		total += m.weight + 1
+	}
+	n := rand.Intn(total)
+	for _, m := range candidates {
+		n -= m.weight + 1
+		if n < 0 {
+			return m
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// selectMirror 为 country 的客户端选择提供 filePath 的镜像，返回 nil 时使用上游。
+func (rd *redirector) selectMirror(filePath, country string) *redirectMirror {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if _, ok := rd.newFiles[filePath]; ok {
+		if cdn := rd.mirrors["default"]; cdn != nil && cdn.hasFile(filePath, 100) {
+			return cdn
+		}
+		return nil
+	}
+
+	usable := func(m *redirectMirror) bool {
+		return m != nil && m.weight >= 0 && m.hasFile(filePath, rd.minProgress)
+	}
+
+	for _, id := range rd.prefs[country] {
+		if m := rd.mirrors[id]; usable(m) {
+			return m
+		}
+	}
+
+	if country != "" {
+		var candidates []*redirectMirror
+		for _, m := range rd.mirrors {
+			if m.id != "default" && m.country == country && usable(m) {
+				candidates = append(candidates, m)
+			}
+		}
+		if m := pickWeighted(candidates); m != nil {
+			return m
+		}
+	}
+
+	for _, id := range rd.prefs["*"] {
+		if m := rd.mirrors[id]; usable(m) {
+			return m
+		}
+	}
+
+	if cdn := rd.mirrors["default"]; usable(cdn) {
+		return cdn
+	}
+	return nil
+}
+
+func (rd *redirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	filePath := strings.TrimPrefix(r.URL.Path, "/")
+	filePath = strings.TrimPrefix(filePath, repoName+"/")
+	if filePath == "" || strings.Contains(filePath, "..") {
+		http.NotFound(w, r)
+		return
+	}
+
+	country := rd.geo.lookup(rd.getClientIP(r))
+	target := joinUrl(baseUrl, filePath)
+	mirrorId := "upstream"
+	if m := rd.selectMirror(filePath, country); m != nil {
+		target = m.url(filePath)
+		mirrorId = m.id
+	}
+	w.Header().Set("X-Mirror-Id", mirrorId)
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func loadRedirectPrefs(filename string) (map[string][]string, error) {
+	prefs := make(map[string][]string)
+	if filename == "" {
+		return prefs, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var v map[string][]string
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	for country, ids := range v {
+		prefs[strings.ToUpper(country)] = ids
+	}
+	return prefs, nil
+}
+
+// redirectMain 实现 redirect 子命令。
+func redirectMain(args []string) {
+	fs := flag.NewFlagSet("redirect", flag.ExitOnError)
+	var listen, geoIPFile, prefsFile string
+	var interval time.Duration
+	rd := &redirector{}
+	fs.StringVar(&listen, "listen", ":8081", "http listen address")
+	fs.StringVar(&rd.runPath, "run", filepath.Join("result", "run.json"),
+		"JSON result of cdn-check, or a directory of results such as serve-data/runs")
+	fs.Float64Var(&rd.minProgress, "min-progress", 95,
+		"minimum progress of a mirror to serve pool files not sampled in the run")
+	fs.BoolVar(&rd.trustProxy, "trust-proxy", false, "use the client address in X-Forwarded-For")
+	fs.StringVar(&geoIPFile, "geoip", "",
+		"CSV ip to country database: start,end,country (DB-IP country lite or IP2Location LITE DB1)")
+	fs.StringVar(&prefsFile, "prefs", "",
+		`JSON file of preferred mirror ids per country, e.g. {"CN": ["a", "b"], "*": ["c"]}`)
+	fs.DurationVar(&interval, "refresh", 5*time.Minute, "interval to reload results and changelists")
+	fs.Parse(args)
+
+	var err error
+	if geoIPFile != "" {
+		rd.geo, err = loadGeoIPDB(geoIPFile)
+		if err != nil {
+			fatal(err)
+		}
+		log.Printf("redirect: loaded %d ip ranges\n", len(rd.geo.ranges))
+	}
+	rd.prefs, err = loadRedirectPrefs(prefsFile)
+	if err != nil {
+		fatal(err)
+	}
+	err = rd.reload()
+	if err != nil {
+		fatal(err)
+	}
+	err = rd.updateNewFiles()
+	if err != nil {
+		log.Println("WARN: redirect:", err)
+	}
+	go rd.refresh(interval)
+
+	log.Println("redirect listen:", listen)
+	fatal(http.ListenAndServe(listen, rd))
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"flag"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"mirror_status/sink"
+)
+
+// 把一次检测的结果生成静态 HTML 报告，可以直接放在网页服务器的目录中：
+//
+//	DIR/index.html                    所有报告，新的在前面
+//	DIR/<run id>/index.html           镜像总览（按进度排序）和 CDN 节点按地区的进度
+//	DIR/<run id>/mirrors/<id>.html    镜像的错误、不一致和一致的文件，CDN 按节点分开列出
+
+const reportTemplateText = `{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+th { background: #eee; }
+td.num { text-align: right; }
+.ok { color: #080; }
+.bad { color: #c00; }
+.url { font-family: monospace; font-size: 90%; }
+</style>
+</head>
+<body>
+{{end}}
+
+{{define "progress"}}<span class="{{if ge . 100.0}}ok{{else}}bad{{end}}">{{printf "%.2f" .}}%</span>{{end}}
+
+{{define "runs"}}{{template "head" "cdn-check reports"}}
+<h1>cdn-check reports</h1>
+<ul>
+{{range .}}<li><a href="{{.}}/index.html">{{.}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+{{end}}
+
+{{define "run"}}{{template "head" (print "cdn-check " .RunId)}}
+<h1>cdn-check {{.RunId}}</h1>
+<p>{{.StartTime.Format "2006-01-02 15:04:05 MST"}} - {{.EndTime.Format "2006-01-02 15:04:05 MST"}}
+({{.Duration}}), upstream <a href="{{.Upstream}}">{{.Upstream}}</a>
+{{with .UpstreamResult}}coverage {{template "progress" .Percent}}, {{.NumErrs}} errors{{end}}</p>
+
+<h2>Mirrors</h2>
+<table>
+<tr><th>#</th><th>Mirror</th><th>Country</th><th>State</th><th>Progress</th><th>Errors</th><th>Not equal</th><th>Files</th><th>Vantage</th></tr>
+{{range $i, $m := .Mirrors}}<tr>
+<td class="num">{{inc $i}}</td>
+<td><a href="{{$m.Page}}">{{$m.Name}}</a>{{if $m.Nodes}} (CDN, {{$m.Nodes}} nodes){{end}}<br><span class="url">{{$m.UrlPrefix}}</span></td>
+<td>{{$m.Country}}</td>
+<td>{{$m.State}}</td>
+<td class="num">{{template "progress" $m.Percent}}</td>
+<td class="num">{{$m.NumErrs}}</td>
+<td class="num">{{$m.NumNotEqual}}</td>
+<td class="num">{{$m.NumFiles}}</td>
+<td>{{$m.Vantage}}</td>
+</tr>
+{{end}}</table>
+
+{{if .Regions}}<h2>CDN</h2>
+<table>
+<tr><th>Region</th><th>Nodes</th><th>Average</th><th>Lowest</th><th>Nodes below 100%</th></tr>
+{{range .Regions}}<tr>
+<td>{{.Region}}</td>
+<td class="num">{{len .Nodes}}</td>
+<td class="num">{{template "progress" .Average}}</td>
+<td class="num">{{template "progress" .Lowest}}</td>
+<td>{{range .Nodes}}{{if lt .Percent 100.0}}<a href="{{.Page}}#node-{{.Address}}">{{.Address}}</a> {{template "progress" .Percent}}<br>{{end}}{{end}}</td>
+</tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+{{end}}
+
+{{define "files"}}{{if .Records}}<h3>{{.Title}} ({{len .Records}})</h3>
+<table>
+<tr><th>File</th><th>Upstream</th><th>Mirror</th>{{if .Errors}}<th>Error</th>{{end}}</tr>
+{{range .Records}}<tr>
+<td class="url">{{.Path}}</td>
+<td><a href="{{.UpstreamUrl}}">upstream</a></td>
+<td><a href="{{.MirrorUrl}}">mirror</a></td>
+{{if $.Errors}}<td>{{.ErrClass}}: {{.Err}}</td>{{end}}
+</tr>
+{{end}}</table>
+{{end}}{{end}}
+
+{{define "mirror"}}{{template "head" (print .Name " - cdn-check " .RunId)}}
+<p><a href="../index.html">cdn-check {{.RunId}}</a></p>
+<h1>{{.Name}}</h1>
+<p>id {{.Id}}, {{.Country}}, {{.State}}</p>
+{{range .Results}}<h2{{if .Address}} id="node-{{.Address}}"{{end}}>{{if .Address}}Node {{.Address}}{{if .Region}} ({{.Region}}){{end}}{{else}}{{.UrlPrefix}}{{end}}</h2>
+<p>progress {{template "progress" .Percent}}, {{.NumErrs}} errors, {{len .Files}} files{{if .Vantage}}, tested from {{.Vantage}}{{end}}</p>
+{{template "files" .Errors}}{{template "files" .NotEqual}}{{template "files" .Equal}}{{end}}
+</body>
+</html>
+{{end}}`
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(reportTemplateText))
+
+type reportRunData struct {
+	RunId          string
+	StartTime      time.Time
+	EndTime        time.Time
+	Duration       time.Duration
+	Upstream       string
+	UpstreamResult *reportResult
+	Mirrors        []*reportMirror
+	Regions        []*reportRegion
+}
+
+type reportMirror struct {
+	Id          string
+	Name        string
+	Country     string
+	State       string
+	UrlPrefix   string
+	Vantage     string
+	Page        string
+	Nodes       int
+	Percent     float64 // CDN 取最低的节点
+	NumErrs     int
+	NumNotEqual int
+	NumFiles    int
+	Results     []*reportResult
+	RunId       string
+}
+
+type reportResult struct {
+	Address   string
+	Region    string
+	UrlPrefix string
+	Vantage   string
+	Page      string
+	Percent   float64
+	NumErrs   int
+	Files     []*reportFile
+	Errors    *reportFileList
+	NotEqual  *reportFileList
+	Equal     *reportFileList
+}
+
+type reportFileList struct {
+	Title   string
+	Errors  bool
+	Records []*reportFile
+}
+
+type reportFile struct {
+	Path        string
+	UpstreamUrl string
+	MirrorUrl   string
+	Err         string
+	ErrClass    string
+}
+
+type reportRegion struct {
+	Region  string
+	Nodes   []*reportResult
+	Average float64
+	Lowest  float64
+}
+
+// getLocalizedCountry 返回镜像所在国家在 locale 下的名称，CMS 中没有时返回国家代码。
+func (m *mirror) getLocalizedCountry(locale string) string {
+	if location := m.Locale[locale]["location"]; location != "" {
+		return location
+	}
+	return strings.ToUpper(m.Country)
+}
+
+var regReportUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func reportMirrorPage(mirrorId string) string {
+	return "mirrors/" + regReportUnsafe.ReplaceAllString(mirrorId, "_") + ".html"
+}
+
+func newReportResult(tr *testResult, upstream string) *reportResult {
+	rr := &reportResult{
+		Address:   tr.cdnNodeAddress,
+		Region:    tr.nodeRegion,
+		UrlPrefix: tr.urlPrefix,
+		Vantage:   tr.vantage,
+		Percent:   tr.percent,
+		NumErrs:   tr.numErrs,
+		Errors:    &reportFileList{Title: "Errors", Errors: true},
+		NotEqual:  &reportFileList{Title: "Not equal"},
+		Equal:     &reportFileList{Title: "Equal"},
+	}
+	for _, record := range tr.records {
+		if record.standard == nil {
+			continue
+		}
+		f := &reportFile{
+			Path:        record.standard.FilePath,
+			UpstreamUrl: record.standard.URL,
+			MirrorUrl:   joinUrl(tr.urlPrefix, record.standard.FilePath),
+		}
+		if f.UpstreamUrl == "" {
+			f.UpstreamUrl = joinUrl(upstream, record.standard.FilePath)
+		}
+		if record.result != nil && record.result.URL != "" {
+			f.MirrorUrl = record.result.URL
+		}
+		rr.Files = append(rr.Files, f)
+		switch {
+		case record.err != nil:
+			f.Err = record.err.Error()
+			f.ErrClass = classifyError(record.err)
+			rr.Errors.Records = append(rr.Errors.Records, f)
+		case record.equal:
+			rr.Equal.Records = append(rr.Equal.Records, f)
+		default:
+			rr.NotEqual.Records = append(rr.NotEqual.Records, f)
+		}
+	}
+	return rr
+}
+
+// newReportData 整理检测结果，CDN 节点的地区为空时用 geoIP 查询国家。
+func newReportData(run *checkRun, locale string, geoIP *geoIPDB) *reportRunData {
+	data := &reportRunData{
+		RunId:     run.id,
+		StartTime: run.startTime,
+		EndTime:   run.endTime,
+		Duration:  run.endTime.Sub(run.startTime).Round(time.Second),
+		Upstream:  baseUrl,
+	}
+	for _, tr := range run.testResults {
+		if tr.upstream {
+			data.Upstream = tr.urlPrefix
+			data.UpstreamResult = &reportResult{Percent: tr.percent, NumErrs: tr.numErrs}
+		}
+	}
+
+	byId := make(map[string]*reportMirror)
+	regions := make(map[string]*reportRegion)
+	for _, tr := range run.testResults {
+		if tr.upstream {
+			continue
+		}
+		rm := byId[tr.name]
+		if rm == nil {
+			rm = &reportMirror{
+				Id:        tr.name,
+				Name:      tr.name,
+				UrlPrefix: tr.urlPrefix,
+				Vantage:   tr.vantage,
+				Page:      reportMirrorPage(tr.name),
+				Percent:   tr.percent,
+				RunId:     run.id,
+			}
+			if m := run.mirrors.get(tr.name); m != nil {
+				rm.Name = m.getLocalizedName(locale)
+				rm.Country = m.getLocalizedCountry(locale)
+				rm.State = sink.MirrorState(m.Weight)
+				rm.UrlPrefix = m.getUrlPrefix()
+			}
+			byId[tr.name] = rm
+			data.Mirrors = append(data.Mirrors, rm)
+		}
+		rr := newReportResult(tr, data.Upstream)
+		rr.Page = rm.Page
+		rm.Results = append(rm.Results, rr)
+		if tr.percent < rm.Percent {
+			rm.Percent = tr.percent
+		}
+		rm.NumErrs += tr.numErrs
+		rm.NumNotEqual += len(rr.NotEqual.Records)
+		rm.NumFiles += len(rr.Files)
+
+		if tr.cdnNodeAddress == "" {
+			continue
+		}
+		rm.Nodes++
+		region := tr.nodeRegion
+		if region == "" {
+			region = strings.ToUpper(geoIP.lookup(net.ParseIP(tr.cdnNodeAddress)))
+		}
+		if region == "" {
+			region = "unknown"
+		}
+		reg := regions[region]
+		if reg == nil {
+			reg = &reportRegion{Region: region, Lowest: tr.percent}
+			regions[region] = reg
+			data.Regions = append(data.Regions, reg)
+		}
+		reg.Nodes = append(reg.Nodes, rr)
+		reg.Average += tr.percent
+		if tr.percent < reg.Lowest {
+			reg.Lowest = tr.percent
+		}
+	}
+
+	// 镜像按进度从高到低，CDN 地区和节点按进度从低到高
+	sort.SliceStable(data.Mirrors, func(i, j int) bool {
+		if data.Mirrors[i].Percent != data.Mirrors[j].Percent {
+			return data.Mirrors[i].Percent > data.Mirrors[j].Percent
+		}
+		return data.Mirrors[i].Id < data.Mirrors[j].Id
+	})
+	for _, reg := range data.Regions {
+		reg.Average /= float64(len(reg.Nodes))
+		sort.Slice(reg.Nodes, func(i, j int) bool {
+			return reg.Nodes[i].Percent < reg.Nodes[j].Percent
+		})
+	}
+	sort.Slice(data.Regions, func(i, j int) bool {
+		if data.Regions[i].Lowest != data.Regions[j].Lowest {
+			return data.Regions[i].Lowest < data.Regions[j].Lowest
+		}
+		return data.Regions[i].Region < data.Regions[j].Region
+	})
+	return data
+}
+
+func writeReportFile(filename, name string, data interface{}) error {
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		return reportTemplate.ExecuteTemplate(w, name, data)
+	})
+}
+
+// writeReport 把检测结果的报告写入 dir/<run id>，并更新 dir/index.html。
+func writeReport(run *checkRun, dir, locale string, geoIP *geoIPDB) error {
+	data := newReportData(run, locale, geoIP)
+	runDir := filepath.Join(dir, regReportUnsafe.ReplaceAllString(run.id, "_"))
+	for _, rm := range data.Mirrors {
+		err := writeReportFile(filepath.Join(runDir, filepath.FromSlash(rm.Page)), "mirror", rm)
+		if err != nil {
+			return err
+		}
+	}
+	err := writeReportFile(filepath.Join(runDir, "index.html"), "run", data)
+	if err != nil {
+		return err
+	}
+	return writeReportIndex(dir)
+}
+
+// writeReportIndex 列出 dir 中所有的报告，run id 按时间排序，新的在前面。
+func writeReportIndex(dir string) error {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var runIds []string
+	for _, fi := range fileInfos {
+		if !fi.IsDir() {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(dir, fi.Name(), "index.html"))
+		if err == nil {
+			runIds = append(runIds, fi.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(runIds)))
+	return writeReportFile(filepath.Join(dir, "index.html"), "runs", runIds)
+}
+
+func reportRunIfNeeded(run *checkRun) {
+	if optReportDir == "" {
+		return
+	}
+	err := writeReport(run, optReportDir, optPublishLocale, nil)
+	if err != nil {
+		log.Println("WARN: report:", err)
+	}
+}
+
+// reportMain 实现 report 子命令，用保存的检测结果生成 HTML 报告。
+func reportMain(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	var runPath, dir, locale, geoIPFile string
+	fs.StringVar(&runPath, "run", filepath.Join("result", "run.json"),
+		"JSON result of cdn-check, or a directory of results such as serve-data/runs")
+	fs.StringVar(&dir, "o", "report", "output directory, e.g. a directory served by the web server")
+	fs.StringVar(&locale, "locale", optPublishLocale, "locale of mirror names and countries")
+	fs.StringVar(&geoIPFile, "geoip", "",
+		"CSV file of ip ranges and countries, for CDN nodes whose region is unknown")
+	fs.Parse(args)
+
+	var geoIP *geoIPDB
+	if geoIPFile != "" {
+		var err error
+		geoIP, err = loadGeoIPDB(geoIPFile)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	filename, _, err := getLatestRunFile(runPath)
+	if err != nil {
+		fatal(err)
+	}
+	run, err := loadCheckRun(filename, optSnapshotDir)
+	if err != nil {
+		fatal(err)
+	}
+	err = writeReport(run, dir, locale, geoIP)
+	if err != nil {
+		fatal(err)
+	}
+}
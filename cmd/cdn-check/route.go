@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// route 指定一部分镜像通过代理或者本机的某个地址检测，在 -routes 文件中配置，例如
+//
+//	[
+//	  {"name": "jp-proxy", "countries": ["JP", "KR"], "proxy": "socks5://10.0.0.2:1080"},
+//	  {"name": "cernet", "mirrors": ["edu-*"], "interface": "eth1"},
+//	  {"name": "corp", "mirrors": ["*"], "proxy": "http://proxy:3128", "vantage": "corp"}
+//	]
+//
+// 按顺序使用第一个匹配的 route，没有匹配的镜像使用默认的 client（环境变量中的代理）。
+// proxy 支持 http、https（CONNECT）和 socks5；sourceAddr 和 interface 指定连接的本地地址，
+// interface 使用网卡的第一个 IPv4 地址，没有时使用第一个 IPv6 地址。
+// 检测结果的 vantage 记录为 route 的 vantage，没有设置时为 route 的名称。
+type route struct {
+	Name       string   `json:"name"`
+	Mirrors    []string `json:"mirrors"`   // 镜像 id 的通配符
+	Countries  []string `json:"countries"` // 国家代码，* 匹配所有国家
+	Proxy      string   `json:"proxy"`
+	SourceAddr string   `json:"sourceAddr"`
+	Interface  string   `json:"interface"`
+	Vantage    string   `json:"vantage"`
+
+	clientNormal *http.Client
+	clientHidden *http.Client
+}
+
+var routes []*route
+
+func (rt *route) match(m *mirror) bool {
+	for _, pattern := range rt.Mirrors {
+		if ok, _ := path.Match(pattern, m.Id); ok {
+			return true
+		}
+	}
+	for _, country := range rt.Countries {
+		if country == "*" || strings.EqualFold(country, m.Country) {
+			return true
+		}
+	}
+	return false
+}
+
+// findRoute 返回检测镜像 m 使用的 route，没有时返回 nil。
+func findRoute(m *mirror) *route {
+	for _, rt := range routes {
+		if rt.match(m) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// getHttpClient 和全局的 getHttpClient 一样按权重选择 client，rt 为 nil 时使用默认的 client。
+func (rt *route) getHttpClient(mirrorWeight int) *http.Client {
+	if rt == nil {
+		return getHttpClient(mirrorWeight)
+	}
+	if mirrorWeight >= 0 {
+		return rt.clientNormal
+	}
+	return rt.clientHidden
+}
+
+func (rt *route) getVantage() string {
+	if rt.Vantage != "" {
+		return rt.Vantage
+	}
+	return rt.Name
+}
+
+// setDefaultVantage 在检测结果还没有 vantage 时设置为 vantage，
+// 通过 route 检测的结果保留 route 的 vantage。
+func setDefaultVantage(tr *testResult, vantage string) {
+	if tr.vantage == "" {
+		tr.vantage = vantage
+	}
+}
+
+func getInterfaceIP(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ip6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if ip6 == nil {
+			ip6 = ipNet.IP
+		}
+	}
+	if ip6 == nil {
+		return nil, fmt.Errorf("interface %s has no usable address", name)
+	}
+	return ip6, nil
+}
+
+func (rt *route) init() error {
+	if rt.Name == "" {
+		return errors.New("route without name")
+	}
+	var proxy func(*http.Request) (*url.URL, error)
+	if rt.Proxy != "" {
+		u, err := url.Parse(rt.Proxy)
+		if err != nil {
+			return err
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	var localIP net.IP
+	if rt.SourceAddr != "" && rt.Interface != "" {
+		return errors.New("sourceAddr and interface are exclusive")
+	}
+	if rt.SourceAddr != "" {
+		localIP = net.ParseIP(rt.SourceAddr)
+		if localIP == nil {
+			return fmt.Errorf("invalid source address %q", rt.SourceAddr)
+		}
+	} else if rt.Interface != "" {
+		var err error
+		localIP, err = getInterfaceIP(rt.Interface)
+		if err != nil {
+			return err
+		}
+	}
+
+	normalCfg, hiddenCfg := getHttpClientConfigs()
+	rt.clientNormal = newHttpClient(normalCfg, proxy, localIP)
+	if optDevEnv {
+		rt.clientHidden = rt.clientNormal
+	} else {
+		rt.clientHidden = newHttpClient(hiddenCfg, proxy, localIP)
+	}
+	return nil
+}
+
+func loadRoutes(filename string) ([]*route, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var result []*route
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, err
+	}
+	for i, rt := range result {
+		err = rt.init()
+		if err != nil {
+			return nil, fmt.Errorf("%s: route %d %s: %v", filename, i, rt.Name, err)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"mirror_status/sink"
+)
+
+const mirrorsUrl = "http://server-12:8900/v1/mirrors"
+
+// checkRun 是一次检测的结果，testResults 的最后一项是上游的结果。
+type checkRun struct {
+	id          string
+	startTime   time.Time
+	endTime     time.Time
+	snapshot    *upstreamSnapshot
+	mirrors     mirrors
+	testResults []*testResult
+}
+
+type upstreamCoverageError struct {
+	percent float64
+	numErrs int
+}
+
+func (err *upstreamCoverageError) Error() string {
+	return fmt.Sprintf("upstream coverage %.3f%% (%d errors) is below %.3f%%, refuse to test mirrors",
+		err.percent, err.numErrs, optMinUpstreamCoverage)
+}
+
+// runCheck 获取快照并检测镜像，mirrorIds 不为空时只检测这些镜像。
+// 上游在检测期间发生变化时调用 onUpstreamChange。
+// 没有需要检测的文件时返回 nil, nil；上游覆盖率过低时返回只包含上游结果的 run
+// 和 *upstreamCoverageError。
+func runCheck(mirrorIds []string, onUpstreamChange func(error)) (*checkRun, error) {
+	t0 := time.Now()
+	mirrors0, err := getUnpublishedMirrors(mirrorsUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(mirrorIds) > 0 {
+		var tempMirrors mirrors
+		for _, id := range mirrorIds {
+			m := mirrors0.get(id)
+			if m == nil {
+				return nil, errors.New("not found mirror " + id)
+			}
+			tempMirrors = append(tempMirrors, m)
+		}
+		mirrors0 = tempMirrors
+	}
+
+	snapshot, err := getUpstreamSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, nil
+	}
+
+	watcher, err := watchUpstream(optUpstreamCheckInterval, onUpstreamChange)
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.stop()
+	if watcher.marker != snapshot.Marker {
+		if optSnapshot == "" {
+			return nil, fmt.Errorf("upstream changed after the snapshot was taken, snapshot %v, now %v",
+				snapshot.Marker, watcher.marker)
+		}
+		log.Printf("WARN: upstream changed since the snapshot was taken, snapshot %v, now %v\n",
+			snapshot.Marker, watcher.marker)
+	}
+
+	run := &checkRun{
+		id:        sink.RunId(t0),
+		startTime: t0,
+		snapshot:  snapshot,
+		mirrors:   mirrors0,
+	}
+
+	upstreamResult := snapshot.upstreamResult()
+	err = upstreamResult.save()
+	if err != nil {
+		log.Println("WARN:", err)
+	}
+	if upstreamResult.percent < optMinUpstreamCoverage {
+		run.testResults = []*testResult{upstreamResult}
+		run.endTime = time.Now()
+		return run, &upstreamCoverageError{
+			percent: upstreamResult.percent,
+			numErrs: upstreamResult.numErrs,
+		}
+	}
+
+	err = activeJournal.begin(run)
+	if err != nil {
+		return nil, err
+	}
+	numMirrors := 0
+	for _, m := range mirrors0 {
+		if !optNoTestHidden || m.Weight >= 0 {
+			numMirrors++
+		}
+	}
+	emitEvent(&event{
+		Type:       eventRunStart,
+		RunId:      run.id,
+		NumMirrors: numMirrors,
+		NumFiles:   len(snapshot.ValidateInfoList),
+	})
+
+	if mirrors0.get("default") != nil {
+		err = prefetchCdnDns(cdnHost)
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}
+	run.testResults = testMirrorsDistributed(run.id, mirrors0, snapshot.ValidateInfoList)
+	run.testResults = append(run.testResults, upstreamResult)
+	run.endTime = time.Now()
+
+	err = watcher.check()
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// getMirrorResults 返回镜像的检测结果，CDN 有多个结果。
+func (run *checkRun) getMirrorResults(mirrorId string) []*testResult {
+	var results []*testResult
+	for _, tr := range run.testResults {
+		if !tr.upstream && tr.name == mirrorId {
+			results = append(results, tr)
+		}
+	}
+	return results
+}
+
+// replaceMirrorResults 用新的检测结果替换镜像以前的结果。
+func (run *checkRun) replaceMirrorResults(mirrorId string, results []*testResult) {
+	var testResults []*testResult
+	for _, tr := range run.testResults {
+		if tr.upstream || tr.name != mirrorId {
+			testResults = append(testResults, tr)
+		}
+	}
+	run.testResults = append(results, testResults...)
+}
+
+type runJSON struct {
+	Id           string            `json:"id"`
+	StartTime    time.Time         `json:"startTime"`
+	EndTime      time.Time         `json:"endTime"`
+	SnapshotHash string            `json:"snapshotHash"`
+	Seed         int64             `json:"seed"`
+	Mirrors      mirrors           `json:"mirrors"`
+	Results      []*testResultJSON `json:"results"`
+}
+
+type testResultJSON struct {
+	Upstream       bool              `json:"upstream,omitempty"`
+	Name           string            `json:"name"`
+	UrlPrefix      string            `json:"urlPrefix"`
+	CdnNodeAddress string            `json:"cdnNodeAddress,omitempty"`
+	NodeRegion     string            `json:"nodeRegion,omitempty"`
+	Vantage        string            `json:"vantage,omitempty"`
+	Percent        float64           `json:"percent"`
+	NumErrs        int               `json:"numErrs"`
+	Latency        time.Duration     `json:"latency"`
+	ErrorClasses   map[string]int    `json:"errorClasses,omitempty"`
+	Records        []*testRecordJSON `json:"records,omitempty"`
+}
+
+type testRecordJSON struct {
+	Standard *FileValidateInfo `json:"standard"`
+	Result   *FileValidateInfo `json:"result,omitempty"`
+	Equal    bool              `json:"equal"`
+	Err      string            `json:"err,omitempty"`
+	ErrClass string            `json:"errClass,omitempty"`
+	Latency  time.Duration     `json:"latency"`
+}
+
+func (tr *testResult) toJSON(withRecords bool) *testResultJSON {
+	v := &testResultJSON{
+		Upstream:       tr.upstream,
+		Name:           tr.name,
+		UrlPrefix:      tr.urlPrefix,
+		CdnNodeAddress: tr.cdnNodeAddress,
+		NodeRegion:     tr.nodeRegion,
+		Vantage:        tr.vantage,
+		Percent:        tr.percent,
+		NumErrs:        tr.numErrs,
+		Latency:        tr.avgLatency(),
+		ErrorClasses:   tr.errorClasses(),
+	}
+	if !withRecords {
+		return v
+	}
+	for _, record := range tr.records {
+		v.Records = append(v.Records, newTestRecordJSON(record))
+	}
+	return v
+}
+
+func newTestRecordJSON(record testRecord) *testRecordJSON {
+	rv := &testRecordJSON{
+		Standard: record.standard,
+		Result:   record.result,
+		Equal:    record.equal,
+		Latency:  record.latency,
+	}
+	if record.err != nil {
+		rv.Err = record.err.Error()
+		rv.ErrClass = classifyError(record.err)
+	}
+	return rv
+}
+
+func (rv *testRecordJSON) toTestRecord() testRecord {
+	record := testRecord{
+		standard: rv.Standard,
+		result:   rv.Result,
+		equal:    rv.Equal,
+		latency:  rv.Latency,
+	}
+	if rv.Err != "" {
+		record.err = errors.New(rv.Err)
+	}
+	return record
+}
+
+func (v *testResultJSON) toTestResult() *testResult {
+	tr := &testResult{
+		upstream:       v.Upstream,
+		name:           v.Name,
+		urlPrefix:      v.UrlPrefix,
+		cdnNodeAddress: v.CdnNodeAddress,
+		nodeRegion:     v.NodeRegion,
+		vantage:        v.Vantage,
+		percent:        v.Percent,
+		numErrs:        v.NumErrs,
+	}
+	for _, rv := range v.Records {
+		tr.records = append(tr.records, rv.toTestRecord())
+	}
+	return tr
+}
+
+func (run *checkRun) toJSON() *runJSON {
+	v := &runJSON{
+		Id:        run.id,
+		StartTime: run.startTime,
+		EndTime:   run.endTime,
+		Mirrors:   run.mirrors.withoutContacts(),
+	}
+	if run.snapshot != nil {
+		v.SnapshotHash = run.snapshot.Hash
+		v.Seed = run.snapshot.Seed
+	}
+	for _, tr := range run.testResults {
+		v.Results = append(v.Results, tr.toJSON(true))
+	}
+	return v
+}
+
+// save 把检测结果保存为 JSON 文件。
+func (run *checkRun) save(filename string) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(run.toJSON())
+	if err != nil {
+		return err
+	}
+	tmpFile := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
+
+// loadCheckRun 加载 save 保存的检测结果，快照从 snapshotDir 中按哈希加载，
+// 快照不存在时 run.snapshot 为 nil。
+func loadCheckRun(filename, snapshotDir string) (*checkRun, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var v runJSON
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	run := &checkRun{
+		id:        v.Id,
+		startTime: v.StartTime,
+		endTime:   v.EndTime,
+		mirrors:   v.Mirrors,
+	}
+	for _, trv := range v.Results {
+		run.testResults = append(run.testResults, trv.toTestResult())
+	}
+
+	if v.SnapshotHash != "" {
+		snapshotFile := filepath.Join(snapshotDir, "snapshot-"+v.SnapshotHash+".json")
+		run.snapshot, err = loadUpstreamSnapshot(snapshotFile)
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}
+	return run, nil
+}
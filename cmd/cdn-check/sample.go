@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 分层抽样：按 component/arch/changelist 把 pool 中的文件分层，每层按配额抽样，
+// 层内再按源码包轮流选取，避免一个源码包的大量二进制包占满样本。
+
+type sampleQuota struct {
+	pattern string
+	n       int
+}
+
+// parseSampleQuotas 解析 -sample-quota 参数，格式为 pattern=n，多个用逗号分隔，
+// pattern 匹配 component/arch/changelist，可以省略后面的部分，例如
+// "main/amd64=100,non-free=20,*/arm64=30"。
+func parseSampleQuotas(str string) ([]sampleQuota, error) {
+	var quotas []sampleQuota
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("parseSampleQuotas: invalid quota %q", item)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("parseSampleQuotas: invalid quota %q: %v", item, err)
+		}
+		pattern := parts[0]
+		for strings.Count(pattern, "/") < 2 {
+			pattern += "/*"
+		}
+		_, err = path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("parseSampleQuotas: invalid pattern %q: %v", parts[0], err)
+		}
+		quotas = append(quotas, sampleQuota{pattern: pattern, n: n})
+	}
+	return quotas, nil
+}
+
+// parseDebPath 从 pool/<component>/<prefix>/<source>/<name>_<version>_<arch>.deb
+// 中解析出 component、源码包名和架构，源码包文件的架构是 source。
+func parseDebPath(filePath string) (component, source, arch string) {
+	parts := strings.Split(filePath, "/")
+	if len(parts) >= 5 && parts[0] == "pool" {
+		component = parts[1]
+		source = parts[3]
+	}
+	base := path.Base(filePath)
+	ext := path.Ext(base)
+	if ext == ".deb" || ext == ".udeb" {
+		base = strings.TrimSuffix(base, ext)
+		if idx := strings.LastIndex(base, "_"); idx != -1 {
+			arch = base[idx+1:]
+		}
+	} else {
+		arch = "source"
+	}
+	if component == "" {
+		component = "unknown"
+	}
+	if source == "" {
+		source = path.Dir(filePath)
+	}
+	if arch == "" {
+		arch = "unknown"
+	}
+	return
+}
+
+type sampleStratum struct {
+	key   string
+	quota int
+	// 源码包名 -> 文件
+	sources map[string][]string
+	size    int
+}
+
+func (s *sampleStratum) add(source, file string) {
+	s.sources[source] = append(s.sources[source], file)
+	s.size++
+}
+
+// selectFiles 在层内按源码包轮流选取，每个源码包最多选 maxPerSource 个文件。
+func (s *sampleStratum) selectFiles(maxPerSource int, rng *rand.Rand) []string {
+	sources := make([]string, 0, len(s.sources))
+	for source, files := range s.sources {
+		sort.Strings(files)
+		rng.Shuffle(len(files), func(i, j int) {
+			files[i], files[j] = files[j], files[i]
+		})
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	rng.Shuffle(len(sources), func(i, j int) {
+		sources[i], sources[j] = sources[j], sources[i]
+	})
+
+	var result []string
+	for round := 0; len(result) < s.quota; round++ {
+		if maxPerSource > 0 && round >= maxPerSource {
+			break
+		}
+		var picked bool
+		for _, source := range sources {
+			files := s.sources[source]
+			if round >= len(files) {
+				continue
+			}
+			result = append(result, files[round])
+			picked = true
+			if len(result) >= s.quota {
+				break
+			}
+		}
+		if !picked {
+			break
+		}
+	}
+	return result
+}
+
+// randSelectN 从 in（文件路径 -> changelist 名）中分层抽取大约 n 个文件。
+// 相同的输入和 rng 种子得到相同的结果。
+func randSelectN(in map[string]string, n int, rng *rand.Rand) (result []string) {
+	strataMap := make(map[string]*sampleStratum)
+	for file, changelist := range in {
+		component, source, arch := parseDebPath(file)
+		key := component + "/" + arch + "/" + changelist
+		stratum, ok := strataMap[key]
+		if !ok {
+			stratum = &sampleStratum{
+				key:     key,
+				quota:   -1,
+				sources: make(map[string][]string),
+			}
+			strataMap[key] = stratum
+		}
+		stratum.add(source, file)
+	}
+
+	strata := make([]*sampleStratum, 0, len(strataMap))
+	for _, stratum := range strataMap {
+		strata = append(strata, stratum)
+	}
+	sort.Slice(strata, func(i, j int) bool {
+		return strata[i].key < strata[j].key
+	})
+
+	allocateSampleQuotas(strata, n)
+
+	for _, stratum := range strata {
+		files := stratum.selectFiles(optSampleMaxPerSource, rng)
+		result = append(result, files...)
+	}
+	return
+}
+
+// allocateSampleQuotas 先应用 -sample-quota 中配置的配额，
+// 剩余的样本数按大小比例分给其他层，每层至少 optSampleMinPerStratum 个，
+// 总数不超过 n。层太多、最小配额的总和超过剩余的样本数时降低最小配额。
+func allocateSampleQuotas(strata []*sampleStratum, n int) {
+	remaining := n
+	var rest []*sampleStratum
+	var restSize int
+	for _, stratum := range strata {
+		for _, q := range sampleQuotas {
+			if ok, _ := path.Match(q.pattern, stratum.key); ok {
+				stratum.quota = q.n
+				break
+			}
+		}
+		if stratum.quota >= 0 {
+			remaining -= stratum.quota
+		} else {
+			rest = append(rest, stratum)
+			restSize += stratum.size
+		}
+	}
+	if remaining < 0 {
+		log.Printf("WARN: sample: quotas of -sample-quota exceed -sample-size %d\n", n)
+		remaining = 0
+	}
+	if len(rest) == 0 {
+		return
+	}
+
+	minQuota := optSampleMinPerStratum
+	if minQuota < 0 {
+		minQuota = 0
+	}
+	if minQuota*len(rest) > remaining {
+		log.Printf("WARN: sample: %d strata can not get -sample-min-per-stratum %d files each "+
+			"in %d samples, lowered to %d\n", len(rest), minQuota, remaining, remaining/len(rest))
+		minQuota = remaining / len(rest)
+	}
+
+	// 每层先分到最小配额，剩下的按大小比例分配，取整余下的给大的层
+	extra := remaining - minQuota*len(rest)
+	allocated := 0
+	for _, stratum := range rest {
+		stratum.quota = minQuota
+		if restSize > 0 {
+			stratum.quota += extra * stratum.size / restSize
+		}
+		allocated += stratum.quota
+	}
+	bySize := make([]*sampleStratum, len(rest))
+	copy(bySize, rest)
+	sort.SliceStable(bySize, func(i, j int) bool {
+		return bySize[i].size > bySize[j].size
+	})
+	for i := 0; allocated < remaining && i < len(bySize); i++ {
+		bySize[i].quota++
+		allocated++
+	}
+}
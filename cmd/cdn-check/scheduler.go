@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// scheduler 用固定数量（-concurrency）的 worker 执行所有镜像的文件检测任务，
+// 全局的并发数不再是各层 pool 大小的乘积。
+//
+// 每个镜像（CDN 的每个节点、上游）有自己的队列，同一个队列同时运行的任务不超过队列的 maxRunning。
+// worker 优先执行已发布镜像的任务，同一优先级的队列轮流执行，大镜像不会让其他镜像一直等待。
+// 队列有主机时，同一个主机同时运行的任务不超过 -host-concurrency，开始任务的速率不超过 -host-rate，
+// 主机忙的队列先跳过，worker 不会阻塞在一个主机上。任务在重试前用 sleep 等待，等待期间 worker 执行其他任务。
+type scheduler struct {
+	once sync.Once
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	limit  int
+	queues []*schedQueue // 有任务在等待或者运行的队列
+	next   int           // 轮流执行时下一个检查的队列
+
+	numQueued  [2]int // 0 隐藏，1 已发布
+	numRunning int    // 正在运行的任务，不包括 sleep 中的任务
+	numDone    int
+
+	workers int // worker 的数量，sleep 的任务占用的 worker 由新的 worker 代替
+	parked  int // sleep 中的任务
+	waking  int // sleep 结束等待继续运行的任务，优先于新的任务
+
+	hostRunning map[string]int       // 主机 -> 运行中的任务数
+	hostNext    map[string]time.Time // 主机 -> 下一个任务最早开始的时间
+	wakeAt      time.Time            // 等待主机的速率限制时唤醒 worker 的时间
+
+	mirrorsTotal    int
+	mirrorsFinished int
+}
+
+// schedQueue 是一个镜像的任务队列。
+type schedQueue struct {
+	s          *scheduler
+	name       string
+	host       string // 为空时不按主机限制
+	published  bool
+	maxRunning int
+
+	jobs    []func()
+	running int
+	active  bool // 在 s.queues 中
+	wg      sync.WaitGroup
+}
+
+var testScheduler = &scheduler{}
+
+func (s *scheduler) start() {
+	s.once.Do(func() {
+		s.cond = sync.NewCond(&s.mu)
+		s.limit = optConcurrency
+		if s.limit <= 0 {
+			s.limit = 1
+		}
+		s.hostRunning = make(map[string]int)
+		s.hostNext = make(map[string]time.Time)
+		s.workers = s.limit
+		for i := 0; i < s.limit; i++ {
+			go s.worker()
+		}
+	})
+}
+
+// newQueue 创建队列，host 是任务请求的主机（politeHost），published 的队列优先执行，
+// maxRunning 是队列的并发数。
+func (s *scheduler) newQueue(name, host string, published bool, maxRunning int) *schedQueue {
+	s.start()
+	if maxRunning <= 0 {
+		maxRunning = 1
+	}
+	return &schedQueue{
+		s:          s,
+		name:       name,
+		host:       host,
+		published:  published,
+		maxRunning: maxRunning,
+	}
+}
+
+func priorityIndex(published bool) int {
+	if published {
+		return 1
+	}
+	return 0
+}
+
+// add 把任务加入队列。
+func (q *schedQueue) add(job func()) {
+	s := q.s
+	q.wg.Add(1)
+	s.mu.Lock()
+	q.jobs = append(q.jobs, job)
+	if !q.active {
+		q.active = true
+		s.queues = append(s.queues, q)
+	}
+	s.numQueued[priorityIndex(q.published)]++
+	s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// wait 等待队列中的任务全部完成。
+func (q *schedQueue) wait() {
+	q.wg.Wait()
+}
+
+// hostReady 返回主机现在能否开始新的任务，调用时持有 s.mu。
+// 因为速率限制不能开始时，安排在可以开始时唤醒 worker。
+func (s *scheduler) hostReady(host string, now time.Time) bool {
+	if host == "" {
+		return true
+	}
+	if optHostConcurrency > 0 && s.hostRunning[host] >= optHostConcurrency {
+		return false
+	}
+	if next := s.hostNext[host]; next.After(now) {
+		s.wakeUpAt(next, now)
+		return false
+	}
+	return true
+}
+
+// wakeUpAt 在 t 时唤醒等待的 worker，已经安排了更早的唤醒时什么都不做。调用时持有 s.mu。
+func (s *scheduler) wakeUpAt(t, now time.Time) {
+	if !s.wakeAt.IsZero() && s.wakeAt.After(now) && !s.wakeAt.After(t) {
+		return
+	}
+	s.wakeAt = t
+	time.AfterFunc(t.Sub(now), func() {
+		s.mu.Lock()
+		if s.wakeAt.Equal(t) {
+			s.wakeAt = time.Time{}
+		}
+		s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+}
+
+// pick 选择下一个任务，调用时持有 s.mu。
+func (s *scheduler) pick(now time.Time) (*schedQueue, func()) {
+	for _, published := range []bool{true, false} {
+		if s.numQueued[priorityIndex(published)] == 0 {
+			continue
+		}
+		n := len(s.queues)
+		for i := 0; i < n; i++ {
+			idx := (s.next + i) % n
+			q := s.queues[idx]
+			if q.published != published || len(q.jobs) == 0 || q.running >= q.maxRunning ||
+				!s.hostReady(q.host, now) {
+				continue
+			}
+			job := q.jobs[0]
+			q.jobs[0] = nil
+			q.jobs = q.jobs[1:]
+			s.next = idx + 1
+			if q.host != "" {
+				s.hostRunning[q.host]++
+				if interval := hostInterval(); interval > 0 {
+					s.hostNext[q.host] = now.Add(interval)
+				}
+			}
+			return q, job
+		}
+	}
+	return nil, nil
+}
+
+func (s *scheduler) removeQueue(q *schedQueue) {
+	for i, q1 := range s.queues {
+		if q1 != q {
+			continue
+		}
+		s.queues = append(s.queues[:i], s.queues[i+1:]...)
+		if i < s.next {
+			s.next--
+		}
+		break
+	}
+	q.active = false
+}
+
+func (s *scheduler) worker() {
+	s.mu.Lock()
+	for {
+		// sleep 的任务继续运行后，多出来的 worker 退出
+		if s.workers-s.parked > s.limit {
+			s.workers--
+			s.mu.Unlock()
+			return
+		}
+		var q *schedQueue
+		var job func()
+		if s.numRunning+s.waking < s.limit {
+			q, job = s.pick(time.Now())
+		}
+		if job == nil {
+			s.cond.Wait()
+			continue
+		}
+		q.running++
+		s.numQueued[priorityIndex(q.published)]--
+		s.numRunning++
+		s.mu.Unlock()
+
+		job()
+
+		s.mu.Lock()
+		q.running--
+		s.numRunning--
+		s.numDone++
+		if q.host != "" {
+			s.hostRunning[q.host]--
+		}
+		if len(q.jobs) == 0 && q.running == 0 {
+			s.removeQueue(q)
+		}
+		s.mu.Unlock()
+		// 队列和主机的并发名额空出来了，等待的 worker 可能可以执行这个队列的任务
+		s.cond.Broadcast()
+		q.wg.Done()
+		s.mu.Lock()
+	}
+}
+
+// sleep 在任务中等待 d，例如重试之前。等待期间任务不占用全局的并发名额，
+// 由新的 worker 执行其他任务。只能在调度器的任务中调用。
+func (s *scheduler) sleep(d time.Duration) {
+	s.mu.Lock()
+	s.numRunning--
+	s.parked++
+	if s.workers-s.parked < s.limit {
+		s.workers++
+		go s.worker()
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+
+	time.Sleep(d)
+
+	s.mu.Lock()
+	s.waking++
+	for s.numRunning >= s.limit {
+		s.cond.Wait()
+	}
+	s.waking--
+	s.parked--
+	s.numRunning++
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// beginMirrors 开始检测 n 个镜像，上一批镜像都检测完时重新计数。
+func (s *scheduler) beginMirrors(n int) {
+	s.mu.Lock()
+	if s.mirrorsFinished >= s.mirrorsTotal {
+		s.mirrorsTotal = 0
+		s.mirrorsFinished = 0
+	}
+	s.mirrorsTotal += n
+	s.mu.Unlock()
+}
+
+func (s *scheduler) finishMirror() {
+	s.mu.Lock()
+	s.mirrorsFinished++
+	s.mu.Unlock()
+}
+
+// progressDesc 返回日志中的进度，例如 [已完成的镜像/镜像总数 q=等待的任务数 r=运行的任务数]。
+func (s *scheduler) progressDesc() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("[%d/%d q=%d r=%d]", s.mirrorsFinished, s.mirrorsTotal,
+		s.numQueued[0]+s.numQueued[1], s.numRunning)
+}
+
+// writeMetrics 以 Prometheus 文本格式写出调度器的实时状态。
+func (s *scheduler) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	queued := &metricFamily{name: "scheduler_queued_jobs",
+		help: "Number of file checks waiting for a worker."}
+	queued.add(float64(s.numQueued[1]), "state", "published")
+	queued.add(float64(s.numQueued[0]), "state", "hidden")
+	running := &metricFamily{name: "scheduler_running_jobs",
+		help: "Number of file checks in progress."}
+	running.add(float64(s.numRunning))
+	sleeping := &metricFamily{name: "scheduler_sleeping_jobs",
+		help: "Number of file checks waiting to retry, not counted in the concurrency."}
+	sleeping.add(float64(s.parked))
+	done := &metricFamily{name: "scheduler_completed_jobs",
+		help: "Number of file checks completed since start."}
+	done.add(float64(s.numDone))
+	limit := &metricFamily{name: "scheduler_concurrency",
+		help: "Maximum number of concurrent file checks."}
+	limit.add(float64(s.limit))
+	queues := &metricFamily{name: "scheduler_active_queues",
+		help: "Number of mirrors with file checks waiting or in progress."}
+	queues.add(float64(len(s.queues)))
+	mirrorsTotal := &metricFamily{name: "scheduler_mirrors_total",
+		help: "Number of mirrors in the current run."}
+	mirrorsTotal.add(float64(s.mirrorsTotal))
+	mirrorsFinished := &metricFamily{name: "scheduler_mirrors_finished",
+		help: "Number of mirrors finished in the current run."}
+	mirrorsFinished.add(float64(s.mirrorsFinished))
+	s.mu.Unlock()
+
+	for _, mf := range []*metricFamily{queued, running, sleeping, done, limit, queues,
+		mirrorsTotal, mirrorsFinished} {
+		mf.writeTo(w)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// server 实现 serve 子命令，定时检测所有镜像，通过 HTTP 接口提供最近的检测结果。
+type server struct {
+	dataDir  string
+	maxRuns  int
+	push     bool
+	runCh    chan struct{}
+	mu       sync.Mutex
+	runs     []*checkRun // 按时间排序，最后一个是最新的
+	running  bool
+	checking map[string]bool
+}
+
+func serveMain(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var listen string
+	var interval time.Duration
+	s := &server{
+		runCh:    make(chan struct{}, 1),
+		checking: make(map[string]bool),
+	}
+	fs.StringVar(&listen, "listen", ":8080", "http listen address")
+	fs.DurationVar(&interval, "interval", 6*time.Hour, "interval between scheduled runs")
+	fs.StringVar(&s.dataDir, "data-dir", "serve-data", "directory to save run results")
+	fs.IntVar(&s.maxRuns, "max-runs", 10, "number of runs kept in memory and on disk")
+	fs.BoolVar(&s.push, "push", false, "push results of scheduled runs to the sinks given by -sink")
+	fs.Parse(args)
+	if s.maxRuns <= 0 {
+		fatal("-max-runs must be positive")
+	}
+
+	err := s.loadRuns()
+	if err != nil {
+		log.Println("WARN:", err)
+	}
+
+	go s.schedule(interval)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/runs", s.handleRuns)
+	mux.HandleFunc("/api/runs/", s.handleRun)
+	mux.HandleFunc("/api/mirrors", s.handleMirrors)
+	mux.HandleFunc("/api/mirrors/", s.handleMirror)
+	mux.HandleFunc("/api/cdn", s.handleCdn)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	log.Println("serve listen:", listen)
+	fatal(http.ListenAndServe(listen, mux))
+}
+
+func (s *server) runsDir() string {
+	return filepath.Join(s.dataDir, "runs")
+}
+
+func (s *server) loadRuns() error {
+	fileInfos, err := ioutil.ReadDir(s.runsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var names []string
+	for _, fileInfo := range fileInfos {
+		if strings.HasSuffix(fileInfo.Name(), ".json") {
+			names = append(names, fileInfo.Name())
+		}
+	}
+	sort.Strings(names)
+	if len(names) > s.maxRuns {
+		names = names[len(names)-s.maxRuns:]
+	}
+	for _, name := range names {
+		run, err := loadCheckRun(filepath.Join(s.runsDir(), name), optSnapshotDir)
+		if err != nil {
+			log.Println("WARN:", err)
+			continue
+		}
+		s.runs = append(s.runs, run)
+	}
+	log.Printf("serve: loaded %d runs\n", len(s.runs))
+	return nil
+}
+
+func (s *server) schedule(interval time.Duration) {
+	s.runCh <- struct{}{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.runCh:
+		}
+		s.doRun()
+	}
+}
+
+// triggerRun 请求立即开始一次检测，已经有检测在等待时返回 false。
+func (s *server) triggerRun() bool {
+	select {
+	case s.runCh <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *server) doRun() {
+	s.mu.Lock()
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	// 上游变化时不能中止整个服务，runCheck 结束时会再检查一次并返回错误
+	run, err := runCheck(nil, func(err error) {
+		log.Println("WARN:", err)
+	})
+	if err != nil {
+		log.Println("WARN: run failed:", err)
+		if _, ok := err.(*upstreamCoverageError); ok {
+			evaluateAlertsIfNeeded(run, false)
+			if s.push {
+				pushAllMirrorsTestResults(run)
+			}
+		}
+		return
+	}
+	if run == nil {
+		return
+	}
+
+	s.addRun(run)
+	// addRun 之后 API 可能重新检测镜像并修改 run，之后的处理使用副本
+	run = s.snapshotRun(run)
+	recordHistoryIfNeeded(run)
+	evaluateAlertsIfNeeded(run, true)
+	notifyMirrorAdminsIfNeeded(run)
+	publishRunIfNeeded(run)
+	reportRunIfNeeded(run)
+	if s.push {
+		pushAllMirrorsTestResults(run)
+	}
+}
+
+func (s *server) addRun(run *checkRun) {
+	err := run.save(filepath.Join(s.runsDir(), run.id+".json"))
+	if err != nil {
+		log.Println("WARN:", err)
+	}
+
+	s.mu.Lock()
+	s.runs = append(s.runs, run)
+	var removed []*checkRun
+	if s.maxRuns > 0 && len(s.runs) > s.maxRuns {
+		removed = s.runs[:len(s.runs)-s.maxRuns]
+		s.runs = s.runs[len(s.runs)-s.maxRuns:]
+	}
+	s.mu.Unlock()
+
+	for _, r := range removed {
+		err := os.Remove(filepath.Join(s.runsDir(), r.id+".json"))
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}
+}
+
+// snapshotRun 在 s.mu 下复制 run 的镜像和结果列表，checkMirror 只替换列表，不修改其中的结果。
+func (s *server) snapshotRun(run *checkRun) *checkRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := *run
+	snapshot.mirrors = append(mirrors(nil), run.mirrors...)
+	snapshot.testResults = append([]*testResult(nil), run.testResults...)
+	return &snapshot
+}
+
+func (s *server) latestRun() *checkRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.runs) == 0 {
+		return nil
+	}
+	return s.runs[len(s.runs)-1]
+}
+
+func (s *server) getRun(id string) *checkRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, run := range s.runs {
+		if run.id == id {
+			return run
+		}
+	}
+	return nil
+}
+
+// checkMirror 用最新一次检测的快照重新检测一个镜像，并更新最新一次检测的结果。
+func (s *server) checkMirror(run *checkRun, m *mirror) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.checking, m.Id)
+		s.mu.Unlock()
+	}()
+
+	if m.Id == "default" {
+		err := prefetchCdnDns(cdnHost)
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}
+	results := testMirror(m, run.snapshot.ValidateInfoList)
+	for _, tr := range results {
+		setDefaultVantage(tr, optVantage)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run.replaceMirrorResults(m.Id, results)
+	if run.mirrors.get(m.Id) == nil {
+		run.mirrors = append(run.mirrors, m)
+	}
+	err := run.save(filepath.Join(s.runsDir(), run.id+".json"))
+	if err != nil {
+		log.Println("WARN:", err)
+	}
+}
+
+type runSummary struct {
+	Id           string    `json:"id"`
+	StartTime    time.Time `json:"startTime"`
+	EndTime      time.Time `json:"endTime"`
+	SnapshotHash string    `json:"snapshotHash"`
+	NumMirrors   int       `json:"numMirrors"`
+	NumFiles     int       `json:"numFiles"`
+}
+
+func (run *checkRun) summary() *runSummary {
+	v := &runSummary{
+		Id:         run.id,
+		StartTime:  run.startTime,
+		EndTime:    run.endTime,
+		NumMirrors: len(run.mirrors),
+	}
+	if run.snapshot != nil {
+		v.SnapshotHash = run.snapshot.Hash
+		v.NumFiles = len(run.snapshot.ValidateInfoList)
+	}
+	return v
+}
+
+type mirrorStatus struct {
+	Id        string            `json:"id"`
+	Name      string            `json:"name"`
+	Country   string            `json:"country"`
+	Weight    int               `json:"weight"`
+	UrlPrefix string            `json:"urlPrefix"`
+	RunId     string            `json:"runId"`
+	Results   []*testResultJSON `json:"results"`
+}
+
+func (s *server) getMirrorStatus(run *checkRun, m *mirror, withRecords bool) *mirrorStatus {
+	v := &mirrorStatus{
+		Id:        m.Id,
+		Name:      m.Name,
+		Country:   m.Country,
+		Weight:    m.Weight,
+		UrlPrefix: m.getUrlPrefix(),
+		RunId:     run.id,
+	}
+	for _, tr := range run.getMirrorResults(m.Id) {
+		v.Results = append(v.Results, tr.toJSON(withRecords))
+	}
+	return v
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		log.Println("WARN:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{
+		"error": err.Error(),
+	})
+}
+
+var errNoRun = errors.New("no run finished yet")
+
+// GET /api/runs 列出所有检测，POST /api/runs 立即开始一次检测
+func (s *server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		var result []*runSummary
+		for i := len(s.runs) - 1; i >= 0; i-- {
+			result = append(result, s.runs[i].summary())
+		}
+		running := s.running
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"running": running,
+			"runs":    result,
+		})
+
+	case http.MethodPost:
+		if !s.triggerRun() {
+			writeError(w, http.StatusConflict, errors.New("a run is already pending"))
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{
+			"status": "scheduled",
+		})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// GET /api/runs/<id> 一次检测中所有镜像的结果，不包含每个文件的记录
+func (s *server) handleRun(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/runs/")
+	run := s.getRun(id)
+	if run == nil {
+		writeError(w, http.StatusNotFound, errors.New("not found run "+id))
+		return
+	}
+
+	s.mu.Lock()
+	var results []*testResultJSON
+	for _, tr := range run.testResults {
+		results = append(results, tr.toJSON(false))
+	}
+	summary := run.summary()
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"run":     summary,
+		"results": results,
+	})
+}
+
+// GET /api/mirrors 最新一次检测中所有镜像的状态
+func (s *server) handleMirrors(w http.ResponseWriter, r *http.Request) {
+	run := s.latestRun()
+	if run == nil {
+		writeError(w, http.StatusNotFound, errNoRun)
+		return
+	}
+
+	s.mu.Lock()
+	var result []*mirrorStatus
+	for _, m := range run.mirrors {
+		result = append(result, s.getMirrorStatus(run, m, false))
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, result)
+}
+
+// GET /api/mirrors/<id> 镜像的状态
+// GET /api/mirrors/<id>/records 镜像的状态和每个文件的记录
+// POST /api/mirrors/<id>/check 立即检测这个镜像
+func (s *server) handleMirror(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/mirrors/"), "/")
+	id := parts[0]
+	var action string
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	run := s.latestRun()
+	if run == nil {
+		writeError(w, http.StatusNotFound, errNoRun)
+		return
+	}
+
+	switch action {
+	case "", "records":
+		s.mu.Lock()
+		m := run.mirrors.get(id)
+		var v *mirrorStatus
+		if m != nil {
+			v = s.getMirrorStatus(run, m, action == "records")
+		}
+		s.mu.Unlock()
+		if v == nil {
+			writeError(w, http.StatusNotFound, errors.New("not found mirror "+id))
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+
+	case "check":
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		if run.snapshot == nil {
+			writeError(w, http.StatusConflict, errors.New("snapshot of the latest run is not available"))
+			return
+		}
+		mirrors0, err := getUnpublishedMirrors(mirrorsUrl)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+			return
+		}
+		m := mirrors0.get(id)
+		if m == nil {
+			writeError(w, http.StatusNotFound, errors.New("not found mirror "+id))
+			return
+		}
+
+		s.mu.Lock()
+		checking := s.checking[id]
+		s.checking[id] = true
+		s.mu.Unlock()
+		if checking {
+			writeError(w, http.StatusConflict, errors.New("mirror "+id+" is being checked"))
+			return
+		}
+		go s.checkMirror(run, m)
+		writeJSON(w, http.StatusAccepted, map[string]string{
+			"status": "checking",
+			"runId":  run.id,
+		})
+
+	default:
+		writeError(w, http.StatusNotFound, errors.New("unknown action "+action))
+	}
+}
+
+// GET /api/cdn 最新一次检测中 CDN 各节点的结果
+func (s *server) handleCdn(w http.ResponseWriter, r *http.Request) {
+	run := s.latestRun()
+	if run == nil {
+		writeError(w, http.StatusNotFound, errNoRun)
+		return
+	}
+
+	s.mu.Lock()
+	var result []*testResultJSON
+	for _, tr := range run.testResults {
+		if tr.cdnNodeAddress != "" {
+			result = append(result, tr.toJSON(false))
+		}
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"runId": run.id,
+		"nodes": result,
+	})
+}
+
+// GET /metrics 最新一次检测的 Prometheus 指标
+func (s *server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	// 只在锁内复制最新的检测（checkMirror 只替换其中的列表），
+	// 在锁外生成和发送指标，慢的客户端不会阻塞其他请求和检测
+	s.mu.Lock()
+	isRunning := s.running
+	var run *checkRun
+	if len(s.runs) > 0 {
+		snapshot := *s.runs[len(s.runs)-1]
+		run = &snapshot
+	}
+	s.mu.Unlock()
+
+	var buf bytes.Buffer
+	running := &metricFamily{name: "run_running",
+		help: "Whether a scheduled run is in progress."}
+	if isRunning {
+		running.add(1)
+	} else {
+		running.add(0)
+	}
+	running.writeTo(&buf)
+	testScheduler.writeMetrics(&buf)
+	if run != nil {
+		err := writeRunMetrics(&buf, run)
+		if err != nil {
+			log.Println("WARN:", err)
+		}
+	}
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// upstreamMarkerUrl 在上游每次推送后都会变化，用它的 ETag 和 Last-Modified
+// 判断上游是否发生了变化。
+const upstreamMarkerUrl = changeListUrl + "current.json"
+
+type upstreamMarker struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"lastModified"`
+}
+
+func (m upstreamMarker) String() string {
+	return fmt.Sprintf("etag: %q, last-modified: %q", m.ETag, m.LastModified)
+}
+
+func getUpstreamMarker() (upstreamMarker, error) {
+	var m upstreamMarker
+	resp, err := getHttpClient(9999).Head(upstreamMarkerUrl)
+	if err != nil {
+		return m, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return m, fmt.Errorf("getUpstreamMarker: head %q is not ok, status: %q",
+			upstreamMarkerUrl, resp.Status)
+	}
+	m.ETag = resp.Header.Get("ETag")
+	m.LastModified = resp.Header.Get("Last-Modified")
+	if m.ETag == "" && m.LastModified == "" {
+		return m, errors.New("getUpstreamMarker: no ETag and Last-Modified header")
+	}
+	return m, nil
+}
+
+// upstreamSnapshot 是某一时刻上游文件的校验信息，所有镜像都和它比较。
+type upstreamSnapshot struct {
+	Hash             string              `json:"hash"`
+	CreatedAt        time.Time           `json:"createdAt"`
+	Marker           upstreamMarker      `json:"marker"`
+	Seed             int64               `json:"seed"`
+	Files            []string            `json:"files"`
+	ValidateInfoList []*FileValidateInfo `json:"validateInfoList"`
+	// 从上游获取失败的文件和错误信息
+	UpstreamErrors map[string]string `json:"upstreamErrors"`
+}
+
+func newUpstreamSnapshot(files []string) (*upstreamSnapshot, error) {
+	marker, err := getUpstreamMarker()
+	if err != nil {
+		return nil, err
+	}
+
+	validateInfoList, upstreamErrs, err := getValidateInfoList(files)
+	if err != nil {
+		return nil, err
+	}
+
+	marker1, err := getUpstreamMarker()
+	if err != nil {
+		return nil, err
+	}
+	if marker1 != marker {
+		return nil, fmt.Errorf("upstream changed while taking snapshot, before %v, after %v",
+			marker, marker1)
+	}
+
+	sort.Sort(validateInfoListSlice(validateInfoList))
+	s := &upstreamSnapshot{
+		CreatedAt:        time.Now(),
+		Marker:           marker,
+		Files:            files,
+		ValidateInfoList: validateInfoList,
+		UpstreamErrors:   make(map[string]string),
+	}
+	for file, err := range upstreamErrs {
+		s.UpstreamErrors[file] = err.Error()
+	}
+	s.Hash, err = s.contentHash()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// contentHash 只计算文件校验信息的哈希，相同内容的快照得到相同的文件名。
+func (s *upstreamSnapshot) contentHash() (string, error) {
+	data, err := json.Marshal(s.ValidateInfoList)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (s *upstreamSnapshot) save(dir string) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	filename := filepath.Join(dir, "snapshot-"+s.Hash+".json")
+	if _, err := os.Stat(filename); err == nil {
+		return filename, nil
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(filename, data, 0644)
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+func loadUpstreamSnapshot(filename string) (*upstreamSnapshot, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var s upstreamSnapshot
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := s.contentHash()
+	if err != nil {
+		return nil, err
+	}
+	if hash != s.Hash {
+		return nil, fmt.Errorf("snapshot %q is corrupted, hash %s, expected %s",
+			filename, hash, s.Hash)
+	}
+	return &s, nil
+}
+
+// upstreamResult 把上游当作一个镜像，得到它的检测结果，
+// percent 是成功获取校验信息的文件所占的比例。
+func (s *upstreamSnapshot) upstreamResult() *testResult {
+	records := make([]testRecord, 0, len(s.Files))
+	for _, vi := range s.ValidateInfoList {
+		records = append(records, testRecord{
+			standard: vi,
+			result:   vi,
+			equal:    true,
+		})
+	}
+
+	var files []string
+	for file := range s.UpstreamErrors {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		records = append(records, testRecord{
+			standard: &FileValidateInfo{
+				FilePath: file,
+				URL:      baseUrl + file,
+			},
+			err: errors.New(s.UpstreamErrors[file]),
+		})
+	}
+
+	var percent float64
+	if len(s.Files) > 0 {
+		percent = float64(len(s.ValidateInfoList)) / float64(len(s.Files)) * 100.0
+	}
+	return &testResult{
+		upstream:  true,
+		name:      "upstream",
+		urlPrefix: baseUrl,
+		records:   records,
+		percent:   percent,
+		numErrs:   len(s.UpstreamErrors),
+	}
+}
+
+type validateInfoListSlice []*FileValidateInfo
+
+func (v validateInfoListSlice) Len() int {
+	return len(v)
+}
+
+func (v validateInfoListSlice) Less(i, j int) bool {
+	return v[i].FilePath < v[j].FilePath
+}
+
+func (v validateInfoListSlice) Swap(i, j int) {
+	v[i], v[j] = v[j], v[i]
+}
+
+// upstreamWatcher 在检测镜像期间定时检查上游是否变化，变化时调用 onChange。
+type upstreamWatcher struct {
+	marker   upstreamMarker
+	onChange func(error)
+	quit     chan struct{}
+}
+
+func watchUpstream(interval time.Duration, onChange func(error)) (*upstreamWatcher, error) {
+	marker, err := getUpstreamMarker()
+	if err != nil {
+		return nil, err
+	}
+	w := &upstreamWatcher{
+		marker:   marker,
+		onChange: onChange,
+		quit:     make(chan struct{}),
+	}
+	go w.loop(interval)
+	return w, nil
+}
+
+func (w *upstreamWatcher) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			err := w.check()
+			if err != nil {
+				w.onChange(err)
+				return
+			}
+		}
+	}
+}
+
+// check 返回错误表示上游已经变化，本次检测结果不可信。
+// 获取 marker 失败时只打印警告，不中止检测。
+func (w *upstreamWatcher) check() error {
+	marker, err := getUpstreamMarker()
+	if err != nil {
+		log.Println("WARN:", err)
+		return nil
+	}
+	if marker != w.marker {
+		return fmt.Errorf("upstream changed during the run, before %v, now %v",
+			w.marker, marker)
+	}
+	return nil
+}
+
+func (w *upstreamWatcher) stop() {
+	close(w.quit)
+}
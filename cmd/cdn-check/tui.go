@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tui 在终端中显示检测进度：整体进度和预计剩余时间，以及正在检测的镜像的进度条、错误数和预计剩余时间。
+// 显示期间日志写入 -tui-log，避免和进度混在一起。
+type tui struct {
+	w            io.Writer
+	logFile      *os.File
+	oldLogOutput io.Writer
+
+	mu         sync.Mutex
+	runId      string
+	start      time.Time
+	numMirrors int
+	numFiles   int
+	active     map[string]*tuiMirror // 镜像 id 和 CDN 节点 -> 进度
+	started    map[string]bool       // 已经开始的镜像 id
+	finished   int
+	finishErrs int
+	filesTotal int // 已经开始的镜像和节点的文件数
+	filesDone  int
+	retries    int
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+type tuiMirror struct {
+	mirror string
+	node   string
+	start  time.Time
+	total  int
+	done   int
+	resume int // 上次中断前已经检测的文件数，不计入速度
+	errs   int
+	diff   int
+}
+
+const tuiMaxRows = 30
+
+// startTUI 开始在 w 上显示进度，w 不是终端时返回 nil。
+func startTUI(w *os.File, logFilename string) (*tui, error) {
+	fi, err := w.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		log.Println("WARN: -tui requires a terminal, disabled")
+		return nil, nil
+	}
+	err = os.MkdirAll(filepath.Dir(logFilename), 0755)
+	if err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(logFilename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	oldLogOutput := setLogOutput(logFile)
+
+	ui := &tui{
+		w:            w,
+		logFile:      logFile,
+		oldLogOutput: oldLogOutput,
+		start:        time.Now(),
+		active:       make(map[string]*tuiMirror),
+		started:      make(map[string]bool),
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go ui.loop()
+	return ui, nil
+}
+
+func (ui *tui) loop() {
+	defer close(ui.done)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ui.render()
+		case <-ui.quit:
+			ui.render()
+			return
+		}
+	}
+}
+
+// stop 停止显示，日志恢复原来的输出。
+func (ui *tui) stop() {
+	close(ui.quit)
+	<-ui.done
+	setLogOutput(ui.oldLogOutput)
+	ui.logFile.Close()
+}
+
+func (ui *tui) handleEvent(e *event) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	key := e.Mirror + " " + e.Node
+	switch e.Type {
+	case eventRunStart:
+		ui.runId = e.RunId
+		ui.numMirrors = e.NumMirrors
+		ui.numFiles = e.NumFiles
+	case eventMirrorStart:
+		ui.started[e.Mirror] = true
+		ui.active[key] = &tuiMirror{
+			mirror: e.Mirror,
+			node:   e.Node,
+			start:  e.Time,
+			total:  e.Total,
+			done:   e.Done,
+			resume: e.Done,
+		}
+		ui.filesTotal += e.Total
+		ui.filesDone += e.Done
+	case eventFileChecked:
+		ui.filesDone++
+		m := ui.active[key]
+		if m == nil {
+			return
+		}
+		m.done++
+		switch e.Status {
+		case "error":
+			m.errs++
+		case "not_equal":
+			m.diff++
+		}
+	case eventRetry:
+		ui.retries++
+	case eventMirrorDone:
+		for k, m := range ui.active {
+			if m.mirror == e.Mirror {
+				delete(ui.active, k)
+			}
+		}
+		if !ui.started[e.Mirror] {
+			// 跳过的或者 agent 检测的镜像
+			ui.started[e.Mirror] = true
+			ui.filesTotal += e.Total
+			ui.filesDone += e.Total
+		}
+		ui.finished++
+		ui.finishErrs += e.NumErrs
+	}
+}
+
+// eta 按 done 个文件用了 elapsed 估计剩下的文件需要的时间。
+func eta(elapsed time.Duration, done, total int) string {
+	if done <= 0 || total <= done {
+		return "-"
+	}
+	d := time.Duration(float64(elapsed) / float64(done) * float64(total-done))
+	return d.Round(time.Second).String()
+}
+
+func progressBar(done, total, width int) string {
+	n := 0
+	if total > 0 {
+		n = done * width / total
+	}
+	if n > width {
+		n = width
+	}
+	return "[" + strings.Repeat("#", n) + strings.Repeat(".", width-n) + "]"
+}
+
+func (ui *tui) render() {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	now := time.Now()
+	bw := bufio.NewWriter(ui.w)
+	// 回到左上角并清屏
+	fmt.Fprint(bw, "\x1b[H\x1b[2J")
+
+	// 没有开始的镜像按快照的文件数估计
+	filesTotal := ui.filesTotal
+	if notStarted := ui.numMirrors - len(ui.started); notStarted > 0 {
+		filesTotal += notStarted * ui.numFiles
+	}
+	elapsed := now.Sub(ui.start)
+	fmt.Fprintf(bw, "run %s  mirrors %d/%d  files %d/%d  errors %d  retries %d  elapsed %v  eta %s\n",
+		ui.runId, ui.finished, ui.numMirrors, ui.filesDone, filesTotal, ui.finishErrs, ui.retries,
+		elapsed.Round(time.Second), eta(elapsed, ui.filesDone, filesTotal))
+	fmt.Fprintf(bw, "%s\n\n", testScheduler.progressDesc())
+
+	var active []*tuiMirror
+	for _, m := range ui.active {
+		active = append(active, m)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if !active[i].start.Equal(active[j].start) {
+			return active[i].start.Before(active[j].start)
+		}
+		return active[i].mirror+active[i].node < active[j].mirror+active[j].node
+	})
+	for i, m := range active {
+		if i == tuiMaxRows {
+			fmt.Fprintf(bw, "... %d more\n", len(active)-tuiMaxRows)
+			break
+		}
+		name := m.mirror
+		if m.node != "" {
+			name += " " + m.node
+		}
+		if len(name) > 32 {
+			name = name[:31] + "~"
+		}
+		fmt.Fprintf(bw, "%-32s %s %4s/%-4s err %-3d diff %-3d eta %s\n",
+			name, progressBar(m.done, m.total, 30),
+			strconv.Itoa(m.done), strconv.Itoa(m.total), m.errs, m.diff,
+			eta(now.Sub(m.start), m.done-m.resume, m.total-m.resume))
+	}
+	bw.Flush()
+}
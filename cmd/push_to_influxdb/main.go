@@ -3,7 +3,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strings"
 	"time"
+
+	"mirror_status/sink"
 )
 
 type OldResult struct {
@@ -37,15 +40,40 @@ func main() {
 	flag.StringVar(&user, "user", "admin", "influxdb user")
 	flag.StringVar(&password, "password", "admin", "influxdb password")
 	flag.StringVar(&dbname, "db", "mirror_status", "influxdb database name")
+	var sinks string
+	flag.StringVar(&sinks, "sink", "",
+		"comma separated sinks, see cdn-check -sink, default is the influxdb given by -host")
 	flag.Parse()
 
-	c, err := NewInfluxClient(host, user, password, dbname)
+	c, err := openSinks(sinks, host, user, password, dbname)
 	if err != nil {
 		fmt.Println("E:", err)
 		return
 	}
 	defer c.Close()
 
+	if flag.Arg(0) == "migrate" {
+		src, err := sink.NewInfluxClient(host, user, password, dbname)
+		if err != nil {
+			fmt.Println("E:", err)
+			return
+		}
+		defer src.Close()
+		migrateMain(src, c, flag.Args()[1:])
+		return
+	}
+
+	if flag.Arg(0) == "replay" {
+		for _, dir := range flag.Args()[1:] {
+			numFiles, numPoints, err := sink.ReplaySpool(c, dir)
+			if err != nil {
+				fmt.Println("E:", err)
+			}
+			fmt.Printf("Replayed %d batches with %d points from %q\n", numFiles, numPoints, dir)
+		}
+		return
+	}
+
 	for _, arg := range flag.Args() {
 		vs, err := loadOne(arg)
 		if err != nil {
@@ -59,3 +87,28 @@ func main() {
 		fmt.Printf("Pushed %q with %d items\n", arg, len(vs))
 	}
 }
+
+func openSinks(specs, host, user, password, dbname string) (sink.Sink, error) {
+	if specs == "" {
+		return sink.NewInfluxClient(host, user, password, dbname)
+	}
+
+	opts := sink.Options{
+		InfluxdbAddr: host,
+		InfluxdbName: dbname,
+	}
+	var sinks sink.Multi
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		s, err := sink.Open(spec, opts)
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
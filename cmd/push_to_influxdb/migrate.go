@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/influxdata/influxdb/client/v2"
 	"io/ioutil"
+	"mirror_status/sink"
 	"os"
 	"path"
 	"strings"
@@ -70,7 +71,7 @@ func parseTimeByName(raw string) (time.Time, error) {
 	return time.Now(), fmt.Errorf("Unknown name format:%q %q -> %v", raw, v, err)
 }
 
-func PushMirrorStatus(c *InfluxClient, vs []OldResult) error {
+func PushMirrorStatus(c sink.Sink, vs []OldResult) error {
 	var data []*client.Point
 	for _, v := range vs {
 		p, err := client.NewPoint(
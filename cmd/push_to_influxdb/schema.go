@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+
+	"mirror_status/sink"
+)
+
+// 把第 1 版的 mirrors 和 mirrors_cdn 中的历史数据改写为第 2 版的
+// mirrors_v2 和 mirrors_cdn_v2，镜像的 id、国家和状态从 CMS 中查找。
+
+type cmsMirror struct {
+	Id       string `json:"id"`
+	Weight   int    `json:"weight"`
+	UrlHttp  string `json:"urlHttp"`
+	UrlHttps string `json:"urlHttps"`
+	Country  string `json:"country"`
+}
+
+func getCmsMirrors(url string) ([]*cmsMirror, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getCmsMirrors: fetch %q is not ok, status: %q", url, resp.Status)
+	}
+
+	var v struct {
+		Mirrors []*cmsMirror `json:"mirrors"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return v.Mirrors, nil
+}
+
+type mirrorIndex map[string]*cmsMirror
+
+func newMirrorIndex(mirrors []*cmsMirror) mirrorIndex {
+	idx := make(mirrorIndex)
+	for _, m := range mirrors {
+		idx[m.Id] = m
+		if m.UrlHttp != "" {
+			idx[normalizeUrl("http://"+m.UrlHttp)] = m
+		}
+		if m.UrlHttps != "" {
+			idx[normalizeUrl("https://"+m.UrlHttps)] = m
+		}
+	}
+	return idx
+}
+
+func normalizeUrl(u string) string {
+	return strings.TrimSuffix(u, "/")
+}
+
+// tags 返回第 1 版中以 name 或 mirror_id 标识的镜像在第 2 版中的 tag。
+func (idx mirrorIndex) tags(nameOrId string, t time.Time) sink.MirrorTags {
+	tags := sink.MirrorTags{
+		RunId: sink.RunId(t),
+	}
+	m := idx[nameOrId]
+	if m == nil {
+		m = idx[normalizeUrl(nameOrId)]
+	}
+	if strings.Contains(nameOrId, "://") {
+		tags.Url = nameOrId
+		tags.Protocol = sink.UrlProtocol(nameOrId)
+	}
+	if m != nil {
+		tags.MirrorId = m.Id
+		tags.Country = m.Country
+		tags.State = sink.MirrorState(m.Weight)
+		if tags.Url == "" {
+			if m.UrlHttps != "" {
+				tags.Url = "https://" + m.UrlHttps
+			} else if m.UrlHttp != "" {
+				tags.Url = "http://" + m.UrlHttp
+			}
+			tags.Protocol = sink.UrlProtocol(tags.Url)
+		}
+	}
+	return tags
+}
+
+func migrateMain(src *sink.InfluxClient, dst sink.Sink, args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var since time.Duration
+	var window time.Duration
+	var mirrorsUrl string
+	var dryRun bool
+	fs.DurationVar(&since, "since", 3*365*24*time.Hour, "migrate points newer than this")
+	fs.DurationVar(&window, "window", 7*24*time.Hour, "time range of one query")
+	fs.StringVar(&mirrorsUrl, "mirrors-url", "http://server-12:8900/v1/mirrors", "mirror CMS api url")
+	fs.BoolVar(&dryRun, "dry-run", false, "only count the points")
+	fs.Parse(args)
+
+	mirrors, err := getCmsMirrors(mirrorsUrl)
+	if err != nil {
+		fmt.Println("E:", err)
+		return
+	}
+	idx := newMirrorIndex(mirrors)
+
+	end := time.Now()
+	for t := end.Add(-since); t.Before(end); t = t.Add(window) {
+		t1 := t.Add(window)
+		for _, m := range []struct {
+			measurement string
+			query       string
+			convert     func(r seriesRow) (*client.Point, error)
+		}{
+			{"mirrors", "SELECT progress, latency FROM mirrors WHERE %s GROUP BY name",
+				func(r seriesRow) (*client.Point, error) {
+					tags := idx.tags(r.tags["name"], r.t)
+					if tags.Url == "" {
+						tags.Url = r.tags["name"]
+					}
+					r.fields["schema_version"] = sink.SchemaVersion
+					return client.NewPoint(sink.MeasurementMirrors, tags.Map(), r.fields, r.t)
+				}},
+			{"mirrors_cdn", "SELECT progress FROM mirrors_cdn WHERE %s GROUP BY mirror_id, node_ip_addr",
+				func(r seriesRow) (*client.Point, error) {
+					tags := idx.tags(r.tags["mirror_id"], r.t)
+					if tags.MirrorId == "" {
+						tags.MirrorId = r.tags["mirror_id"]
+					}
+					tags.NodeIpAddr = r.tags["node_ip_addr"]
+					r.fields["schema_version"] = sink.SchemaVersion
+					return client.NewPoint(sink.MeasurementMirrorsCdn, tags.Map(), r.fields, r.t)
+				}},
+		} {
+			where := fmt.Sprintf("time >= %d AND time < %d", t.UnixNano(), t1.UnixNano())
+			rows, err := queryRows(src, fmt.Sprintf(m.query, where))
+			if err != nil {
+				fmt.Println("E:", err)
+				return
+			}
+			var ps []*client.Point
+			for _, r := range rows {
+				p, err := m.convert(r)
+				if err != nil {
+					fmt.Println("E:", err)
+					continue
+				}
+				ps = append(ps, p)
+			}
+			if !dryRun && len(ps) > 0 {
+				err = dst.Write(ps...)
+				if err != nil {
+					fmt.Println("E:", err)
+					return
+				}
+			}
+			fmt.Printf("Migrated %s %s ~ %s with %d points\n", m.measurement,
+				t.Format("2006-01-02"), t1.Format("2006-01-02"), len(ps))
+		}
+	}
+}
+
+type seriesRow struct {
+	tags   map[string]string
+	t      time.Time
+	fields map[string]interface{}
+}
+
+func queryRows(c *sink.InfluxClient, command string) ([]seriesRow, error) {
+	resp, err := c.Query(command)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []seriesRow
+	for _, result := range resp.Results {
+		for _, series := range result.Series {
+			for _, values := range series.Values {
+				r := seriesRow{
+					tags:   series.Tags,
+					fields: make(map[string]interface{}),
+				}
+				for i, col := range series.Columns {
+					if i >= len(values) || values[i] == nil {
+						continue
+					}
+					num, ok := values[i].(json.Number)
+					if !ok {
+						continue
+					}
+					if col == "time" {
+						ns, err := strconv.ParseInt(string(num), 10, 64)
+						if err != nil {
+							return nil, err
+						}
+						r.t = time.Unix(0, ns)
+						continue
+					}
+					f, err := num.Float64()
+					if err != nil {
+						return nil, err
+					}
+					r.fields[col] = f
+				}
+				if len(r.fields) > 0 {
+					rows = append(rows, r)
+				}
+			}
+		}
+	}
+	return rows, nil
+}
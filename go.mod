@@ -6,5 +6,5 @@ require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/gorilla/websocket v1.4.0
 	github.com/influxdata/influxdb v1.6.3
-	github.com/ivpusic/grpool v0.0.0-20170804092134-28957a27c944
+	go.etcd.io/bbolt v1.3.6
 )
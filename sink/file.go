@@ -0,0 +1,55 @@
+package sink
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// DumpClient 以 line protocol 格式把数据点写到 w。
+type DumpClient struct {
+	w io.Writer
+}
+
+func NewDumpClient(w io.Writer) DumpClient {
+	return DumpClient{w: w}
+}
+
+func (c DumpClient) Write(ps ...*client.Point) error {
+	for _, p := range ps {
+		_, err := fmt.Fprintln(c.w, p.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c DumpClient) Close() error { return nil }
+
+// FileSink 以 line protocol 格式把数据点追加到文件。
+type FileSink struct {
+	f *os.File
+}
+
+func NewFileSink(filename string) (*FileSink, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f}, nil
+}
+
+func (s *FileSink) Write(ps ...*client.Point) error {
+	bw := bufio.NewWriter(s.f)
+	err := NewDumpClient(bw).Write(ps...)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (s *FileSink) Close() error { return s.f.Close() }
@@ -0,0 +1,163 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// InfluxClient 写入 InfluxDB 1.x。第一次写入或查询时才连接服务器并创建数据库，
+// 服务器暂时不可用时 Reliable 仍然可以重试和保存到 spool。
+type InfluxClient struct {
+	c      client.Client
+	dbname string
+
+	mu        sync.Mutex
+	connected bool
+}
+
+// connect 检查服务器并创建数据库，成功后不再重复。
+func (c *InfluxClient) connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connected {
+		return nil
+	}
+	_, _, err := c.c.Ping(time.Second)
+	if err != nil {
+		return err
+	}
+	_, err = c.c.Query(client.Query{
+		Command: fmt.Sprintf("create database %s", c.dbname),
+	})
+	if err != nil {
+		return err
+	}
+	c.connected = true
+	return nil
+}
+
+func (c *InfluxClient) Write(ps ...*client.Point) error {
+	err := c.connect()
+	if err != nil {
+		return err
+	}
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database: c.dbname,
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		bp.AddPoint(p)
+	}
+	return c.c.Write(bp)
+}
+
+func (c *InfluxClient) Close() error { return c.c.Close() }
+
+// Query 在数据库中执行 InfluxQL 查询，时间以纳秒为单位返回。
+func (c *InfluxClient) Query(command string) (*client.Response, error) {
+	err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.c.Query(client.Query{
+		Command:   command,
+		Database:  c.dbname,
+		Precision: "ns",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error() != nil {
+		return nil, resp.Error()
+	}
+	return resp, nil
+}
+
+// NewInfluxClient 创建 InfluxDB 1.x 的客户端并立即连接。
+func NewInfluxClient(addr string, user string, passwd string, dbname string) (*InfluxClient, error) {
+	c, err := newInfluxClient(addr, user, passwd, dbname)
+	if err != nil {
+		return nil, err
+	}
+	err = c.connect()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newInfluxClient 创建 InfluxDB 1.x 的客户端，不连接服务器。
+func newInfluxClient(addr string, user string, passwd string, dbname string) (*InfluxClient, error) {
+	c, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:     addr,
+		Username: user,
+		Password: passwd,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &InfluxClient{c: c, dbname: dbname}, nil
+}
+
+// InfluxV2Client 使用 token 写入 InfluxDB 2.x 的 bucket。
+type InfluxV2Client struct {
+	addr   string
+	token  string
+	org    string
+	bucket string
+	client *http.Client
+}
+
+func NewInfluxV2Client(addr, token, org, bucket string) *InfluxV2Client {
+	return &InfluxV2Client{
+		addr:   addr,
+		token:  token,
+		org:    org,
+		bucket: bucket,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *InfluxV2Client) Write(ps ...*client.Point) error {
+	if len(ps) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, p := range ps {
+		buf.WriteString(p.String())
+		buf.WriteByte('\n')
+	}
+
+	query := make(url.Values)
+	query.Set("org", c.org)
+	query.Set("bucket", c.bucket)
+	query.Set("precision", "ns")
+	req, err := http.NewRequest(http.MethodPost, c.addr+"/api/v2/write?"+query.Encode(), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+c.token)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("influxdb2 write: status %s, %s", resp.Status, body)
+	}
+	return nil
+}
+
+func (c *InfluxV2Client) Close() error { return nil }
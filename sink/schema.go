@@ -0,0 +1,83 @@
+package sink
+
+import (
+	"strings"
+	"time"
+)
+
+// 第 2 版数据结构。第 1 版的 mirrors 只有 name（其实是 url 前缀）一个 tag，
+// mirrors_cdn 用 mirror_id，两者无法关联。第 2 版的两个 measurement 使用相同的
+// tag，可以按镜像、国家、是否发布和检测批次分组。
+const (
+	// SchemaVersion 写入第 2 版数据点的 schema_version 字段
+	SchemaVersion = 2
+
+	MeasurementMirrors    = "mirrors_v2"
+	MeasurementMirrorsCdn = "mirrors_cdn_v2"
+
+	// RunIdLayout 是 run_id 的时间格式
+	RunIdLayout = "20060102T150405"
+)
+
+// MirrorTags 是第 2 版 mirrors_v2 和 mirrors_cdn_v2 的 tag。
+type MirrorTags struct {
+	MirrorId   string
+	Url        string
+	Protocol   string
+	Country    string
+	State      string
+	RunId      string
+	NodeIpAddr string
+	Vantage    string
+}
+
+// Pairs 按固定顺序返回非空的 tag，key 和 value 交替排列，用作 Prometheus 的标签。
+func (t MirrorTags) Pairs() []string {
+	var pairs []string
+	add := func(key, value string) {
+		if value != "" {
+			pairs = append(pairs, key, value)
+		}
+	}
+	add("mirror_id", t.MirrorId)
+	add("url", t.Url)
+	add("protocol", t.Protocol)
+	add("country", t.Country)
+	add("state", t.State)
+	add("run_id", t.RunId)
+	add("node_ip_addr", t.NodeIpAddr)
+	add("vantage", t.Vantage)
+	return pairs
+}
+
+// Map 返回非空的 tag。
+func (t MirrorTags) Map() map[string]string {
+	m := make(map[string]string)
+	pairs := t.Pairs()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		m[pairs[i]] = pairs[i+1]
+	}
+	return m
+}
+
+// MirrorState 根据 CMS 中的权重返回镜像的状态，权重为负数的镜像不对用户发布。
+func MirrorState(weight int) string {
+	if weight >= 0 {
+		return "published"
+	}
+	return "hidden"
+}
+
+// UrlProtocol 返回 url 的协议，例如 http、https、ftp。
+func UrlProtocol(url string) string {
+	idx := strings.Index(url, "://")
+	if idx == -1 {
+		return ""
+	}
+	return url[:idx]
+}
+
+// RunId 返回开始时间为 t 的检测批次的 id。
+func RunId(t time.Time) string {
+	return t.Format(RunIdLayout)
+}
@@ -0,0 +1,179 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// Reliable 分批写入 s，每批失败后按指数退避重试，重试仍然失败的批次以
+// line protocol 格式保存到 spoolDir，之后用 ReplaySpool 重新写入。
+type Reliable struct {
+	s          Sink
+	spoolDir   string
+	batchSize  int
+	maxRetries int
+	backoff    time.Duration
+}
+
+const maxBackoff = time.Minute
+
+func NewReliable(s Sink, spoolDir string, batchSize, maxRetries int, backoff time.Duration) *Reliable {
+	if batchSize <= 0 {
+		batchSize = 5000
+	}
+	return &Reliable{
+		s:          s,
+		spoolDir:   spoolDir,
+		batchSize:  batchSize,
+		maxRetries: maxRetries,
+		backoff:    backoff,
+	}
+}
+
+func (r *Reliable) Write(ps ...*client.Point) error {
+	var numSpooled int
+	var lastErr error
+	for len(ps) > 0 {
+		n := r.batchSize
+		if n > len(ps) {
+			n = len(ps)
+		}
+		batch := ps[:n]
+		ps = ps[n:]
+
+		err := r.writeBatch(batch)
+		if err == nil {
+			continue
+		}
+		lastErr = err
+		filename, err := r.spool(batch)
+		if err != nil {
+			return fmt.Errorf("write failed: %v, spool failed: %v", lastErr, err)
+		}
+		log.Printf("WARN: write %d points failed: %v, spooled to %s\n", len(batch), lastErr, filename)
+		numSpooled += len(batch)
+	}
+	if lastErr != nil {
+		return fmt.Errorf("%d points spooled to %s, last error: %v", numSpooled, r.spoolDir, lastErr)
+	}
+	return nil
+}
+
+func (r *Reliable) writeBatch(batch []*client.Point) error {
+	backoff := r.backoff
+	var err error
+	for i := 0; i <= r.maxRetries; i++ {
+		if i > 0 {
+			log.Printf("retry write %d points after %v, err: %v\n", len(batch), backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		err = r.s.Write(batch...)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *Reliable) spool(batch []*client.Point) (string, error) {
+	err := os.MkdirAll(r.spoolDir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = NewDumpClient(&buf).Write(batch...)
+	if err != nil {
+		return "", err
+	}
+	filename := filepath.Join(r.spoolDir, fmt.Sprintf("%d.lp", time.Now().UnixNano()))
+	tmpFile := filename + ".tmp"
+	err = ioutil.WriteFile(tmpFile, buf.Bytes(), 0644)
+	if err != nil {
+		return "", err
+	}
+	return filename, os.Rename(tmpFile, filename)
+}
+
+func (r *Reliable) Close() error { return r.s.Close() }
+
+var regUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// spoolDirName 返回 spec 对应的子目录名，不包含用户名、密码和 token。
+func spoolDirName(spec string) string {
+	if idx := strings.Index(spec, "?"); idx != -1 {
+		spec = spec[:idx]
+	}
+	if idx := strings.Index(spec, "@"); idx != -1 {
+		if schemeIdx := strings.Index(spec, "://"); schemeIdx != -1 && schemeIdx < idx {
+			spec = spec[:schemeIdx+3] + spec[idx+1:]
+		}
+	}
+	return strings.Trim(regUnsafeChars.ReplaceAllString(spec, "_"), "_")
+}
+
+// ReplaySpool 把 dir 中保存的批次按时间顺序写入 s，数据点保留原来的时间戳，
+// 写入成功的文件会被删除，遇到错误时停止。
+func ReplaySpool(s Sink, dir string) (numFiles, numPoints int, err error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var names []string
+	for _, fileInfo := range fileInfos {
+		if !fileInfo.IsDir() && strings.HasSuffix(fileInfo.Name(), ".lp") {
+			names = append(names, fileInfo.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		filename := filepath.Join(dir, name)
+		ps, err := readLineProtocolFile(filename)
+		if err != nil {
+			return numFiles, numPoints, err
+		}
+		err = s.Write(ps...)
+		if err != nil {
+			return numFiles, numPoints, fmt.Errorf("replay %s: %v", filename, err)
+		}
+		err = os.Remove(filename)
+		if err != nil {
+			return numFiles, numPoints, err
+		}
+		numFiles++
+		numPoints += len(ps)
+	}
+	return numFiles, numPoints, nil
+}
+
+func readLineProtocolFile(filename string) ([]*client.Point, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pts, err := models.ParsePointsWithPrecision(data, time.Now(), "ns")
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filename, err)
+	}
+	ps := make([]*client.Point, 0, len(pts))
+	for _, pt := range pts {
+		ps = append(ps, client.NewPointFrom(pt))
+	}
+	return ps, nil
+}
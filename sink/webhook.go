@@ -0,0 +1,68 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// WebhookSink 以 JSON 格式把数据点 POST 到 url。
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+type webhookPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"`
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *WebhookSink) Write(ps ...*client.Point) error {
+	if len(ps) == 0 {
+		return nil
+	}
+	points := make([]webhookPoint, 0, len(ps))
+	for _, p := range ps {
+		fields, err := p.Fields()
+		if err != nil {
+			return err
+		}
+		points = append(points, webhookPoint{
+			Measurement: p.Name(),
+			Tags:        p.Tags(),
+			Fields:      fields,
+			Time:        p.Time(),
+		})
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"points": points,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: status %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *WebhookSink) Close() error { return nil }